@@ -0,0 +1,46 @@
+package sshts
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// accessLogEntry is one line written to AccessLog.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Client   string    `json:"client"`
+	Remote   string    `json:"remote"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Duration float64   `json:"duration_seconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// writeAccessLog writes a JSON line for a finished connection to AccessLog.
+func (s *SSHConn) writeAccessLog(entry *connEntry, res forwardResult) {
+	e := accessLogEntry{
+		Time:     entry.started,
+		ID:       entry.id,
+		Client:   entry.client.String(),
+		Remote:   res.remote,
+		BytesIn:  res.bytesIn,
+		BytesOut: res.bytesOut,
+		Duration: s.clk().Now().Sub(entry.started).Seconds(),
+	}
+	if res.err != nil {
+		e.Error = res.err.Error()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	// connections finish concurrently, lines must not interleave
+	s.accessLogMu.Lock()
+	defer s.accessLogMu.Unlock()
+	if _, err := s.AccessLog.Write(line); err != nil {
+		s.logf("failed to write access log: %s", err)
+	}
+}
@@ -0,0 +1,67 @@
+package sshts
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer the test can read while connections write.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	var log syncBuffer
+	s.AccessLog = &log
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	const n = 5
+	clients := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		conn := dial(t, addr)
+		clients[conn.LocalAddr().String()] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if err := echoErr(conn, "hello"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, "access log lines", func() bool { return strings.Count(log.String(), "\n") == n })
+
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var e accessLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if !clients[e.Client] || e.Remote != srv.EchoAddr || e.ID == "" || e.Time.IsZero() {
+			t.Fatalf("unexpected entry %q", line)
+		}
+		if e.BytesIn != 5 || e.BytesOut != 5 || e.Duration <= 0 {
+			t.Fatalf("unexpected counts in %q", line)
+		}
+		delete(clients, e.Client)
+	}
+}
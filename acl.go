@@ -0,0 +1,40 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+)
+
+// parseCIDRs parses AllowedClientCIDRs. A nil result allows every client.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed client cidr %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// clientAllowed reports whether addr is within one of nets, or nets is empty.
+func clientAllowed(nets []*net.IPNet, addr net.Addr) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package sshts
+
+import (
+	"net"
+	"testing"
+)
+
+// fakeListener hands out the conns sent on conns.
+type fakeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// connFrom returns the client end of a pipe whose server end, accepted by
+// l, reports remote as its peer.
+func (l *fakeListener) connFrom(remote string) net.Conn {
+	client, server := net.Pipe()
+	addr, _ := net.ResolveTCPAddr("tcp", remote)
+	l.conns <- &addrConn{Conn: server, remote: addr}
+	return client
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestAllowedClientCIDRs(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.AllowedClientCIDRs = []string{"127.0.0.1/32"}
+	l := newFakeListener()
+	go s.acceptLoop(l, func(network string, local net.Addr) (net.Conn, string, error) {
+		conn, err := s.dialRemote(network, srv.EchoAddr)
+		return conn, srv.EchoAddr, err
+	})
+	defer l.Close()
+
+	allowed := l.connFrom("127.0.0.1:40000")
+	defer allowed.Close()
+	echo(t, allowed, "hello")
+
+	denied := l.connFrom("192.0.2.7:40000")
+	defer denied.Close()
+	if !refused(denied) {
+		t.Fatal("connection from outside the allowed cidrs was forwarded")
+	}
+	if n := s.RejectedConnections(); n != 1 {
+		t.Fatalf("%d rejected connections, want 1", n)
+	}
+}
+
+func TestAllowedClientCIDRsInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.AllowedClientCIDRs = []string{"127.0.0.1"}
+	if err := s.acceptLoop(newFakeListener(), nil); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+}
@@ -0,0 +1,105 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// EnableAgentForwarding forwards the local ssh agent (SSH_AUTH_SOCK) to the
+// server, so commands started afterwards with RunCommand or StreamCommand
+// can use it to authenticate to further hosts, e.g. git or ssh run on the
+// remote host. Calling it again on the same connection does nothing.
+func (s *SSHConn) EnableAgentForwarding() error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return fmt.Errorf("SSH_AUTH_SOCK is not set, no ssh agent to forward")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to ssh agent: %v", err)
+	}
+	conn.Close()
+
+	s.mu.Lock()
+	if s.agentOnce == nil {
+		s.agentOnce = new(sync.Once)
+	}
+	once := s.agentOnce
+	s.mu.Unlock()
+	// the client takes one handler per channel type, a second
+	// ForwardToRemote fails
+	once.Do(func() {
+		err = agent.ForwardToRemote(client, socket)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward ssh agent: %v", err)
+	}
+	s.mu.Lock()
+	s.agentForwarding = true
+	s.mu.Unlock()
+	return nil
+}
+
+// agentSigners holds the connection to the local ssh agent used for auth.
+// It connects when the keys are first needed and stays open for the agent
+// to sign during the handshake, until the SSHConn is closed.
+type agentSigners struct {
+	socket string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// agentAuth authenticates with the keys held by the local ssh agent.
+func agentAuth() (ssh.AuthMethod, *agentSigners, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, fmt.Errorf("SSH_AUTH_SOCK is not set, no ssh agent to use")
+	}
+	a := &agentSigners{socket: socket}
+	return ssh.PublicKeysCallback(a.Signers), a, nil
+}
+
+// agent returns the agent client, connecting first if needed.
+func (a *agentSigners) agent() (agent.ExtendedAgent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		conn, err := net.Dial("unix", a.socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh agent: %v", err)
+		}
+		a.conn = conn
+		a.client = agent.NewClient(conn)
+	}
+	return a.client, nil
+}
+
+func (a *agentSigners) Signers() ([]ssh.Signer, error) {
+	client, err := a.agent()
+	if err != nil {
+		return nil, err
+	}
+	return client.Signers()
+}
+
+func (a *agentSigners) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn, a.client = nil, nil
+	return err
+}
@@ -0,0 +1,118 @@
+package sshts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves an ssh agent holding keys on SSH_AUTH_SOCK and
+// returns the number of clients connected to it.
+func startTestAgent(t *testing.T, keys ...interface{}) *atomic.Int32 {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	var clients atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			clients.Add(1)
+			go func() {
+				defer clients.Add(-1)
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return &clients
+}
+
+func TestEnableAgentForwarding(t *testing.T) {
+	srv := newTestServer(t)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestAgent(t, key)
+	s := connectTestConn(t, srv)
+
+	if _, _, err := s.RunCommand("agent"); err == nil {
+		t.Fatal("agent reachable before EnableAgentForwarding")
+	}
+	if err := s.EnableAgentForwarding(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableAgentForwarding(); err != nil {
+		t.Fatalf("second EnableAgentForwarding: %v", err)
+	}
+	stdout, stderr, err := s.RunCommand("agent")
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr)
+	}
+	if got := strings.TrimSpace(string(stdout)); got != ssh.FingerprintSHA256(sshPub) {
+		t.Fatalf("forwarded agent lists %q, want %s", got, ssh.FingerprintSHA256(sshPub))
+	}
+
+	// a new connection needs its own handler
+	if err := s.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableAgentForwarding(); err != nil {
+		t.Fatalf("EnableAgentForwarding after Reconnect: %v", err)
+	}
+	if _, stderr, err := s.RunCommand("agent"); err != nil {
+		t.Fatalf("after Reconnect: %v: %s", err, stderr)
+	}
+}
+
+func TestAgentAuthClosedOnClose(t *testing.T) {
+	srv := newTestServer(t)
+	key, err := ssh.ParseRawPrivateKey(srv.ClientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := startTestAgent(t, key)
+
+	s, err := Connect("test", srv.Addr, WithAgent(), WithHostKeyCallback(ssh.FixedHostKey(srv.HostKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := clients.Load(); n != 1 {
+		t.Fatalf("%d agent connections while connected, want 1", n)
+	}
+	s.Close()
+	eventually(t, "agent connection closed", func() bool { return clients.Load() == 0 })
+
+	// Connect after Close uses the agent again
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	eventually(t, "agent connection closed", func() bool { return clients.Load() == 0 })
+}
@@ -0,0 +1,141 @@
+package sshts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// targetDownFor is how long a target whose dial failed is skipped.
+const targetDownFor = 10 * time.Second
+
+// StartBalancedTunnel is like StartTunnel but spreads connections over
+// several remote targets round-robin, all dialed through the same ssh
+// connection. A target the server cannot reach is skipped for a while and
+// the next one is tried instead. With HealthCheckInterval set, targets are
+// also probed in the background and skipped until a probe succeeds again.
+func (s *SSHConn) StartBalancedTunnel(local string, remotes []string) error {
+	if len(remotes) == 0 {
+		return fmt.Errorf("no remote targets")
+	}
+	listener, err := s.listenTunnel(local)
+	if err == errClosing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b := newBalancer(remotes, s.clk())
+	if s.HealthCheckInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		s.spawn(func() { b.healthCheck(s, stop) })
+	}
+	return s.acceptLoop(listener, func(network string, local net.Addr) (net.Conn, string, error) {
+		return b.dial(s, network)
+	})
+}
+
+type balancer struct {
+	mu      sync.Mutex
+	targets []*balancedTarget
+	next    int
+	clock   clock
+}
+
+type balancedTarget struct {
+	addr      string
+	downUntil time.Time
+	unhealthy bool
+}
+
+func newBalancer(remotes []string, clk clock) *balancer {
+	b := &balancer{clock: clk}
+	for _, addr := range remotes {
+		b.targets = append(b.targets, &balancedTarget{addr: normalizeRemoteAddr(addr)})
+	}
+	return b
+}
+
+// pick returns the next target that is not marked down, or the next one in
+// turn if all of them are.
+func (b *balancer) pick() *balancedTarget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	for i := 0; i < len(b.targets); i++ {
+		t := b.targets[(b.next+i)%len(b.targets)]
+		if !t.unhealthy && now.After(t.downUntil) {
+			b.next = (b.next + i + 1) % len(b.targets)
+			return t
+		}
+	}
+	t := b.targets[b.next]
+	b.next = (b.next + 1) % len(b.targets)
+	return t
+}
+
+func (b *balancer) markDown(t *balancedTarget) {
+	b.mu.Lock()
+	t.downUntil = b.clock.Now().Add(targetDownFor)
+	b.mu.Unlock()
+}
+
+func (b *balancer) healthCheck(s *SSHConn, stop <-chan struct{}) {
+	probe := s.HealthProbe
+	if probe == nil {
+		probe = probeDial
+	}
+	for {
+		timer := b.clock.NewTimer(s.HealthCheckInterval)
+		select {
+		case <-timer.C():
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		for _, t := range b.targets {
+			err := probe(s, t.addr)
+			b.mu.Lock()
+			if err != nil && !t.unhealthy {
+				s.logf("target %s marked down: %s", t.addr, err)
+			}
+			t.unhealthy = err != nil
+			if err == nil {
+				t.downUntil = time.Time{}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// probeDial is the default HealthProbe, it checks that the server can open
+// a tcp connection to addr.
+func probeDial(s *SSHConn, addr string) error {
+	conn, err := s.dialRemote("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dial tries each target at most once, marking down the ones the server
+// could not reach.
+func (b *balancer) dial(s *SSHConn, network string) (net.Conn, string, error) {
+	var err error
+	for i := 0; i < len(b.targets); i++ {
+		t := b.pick()
+		var conn net.Conn
+		conn, err = s.dialRemote(network, t.addr)
+		if err == nil {
+			return conn, t.addr, nil
+		}
+		if !errors.Is(err, ErrRemoteDialFailed) {
+			return nil, t.addr, err
+		}
+		b.markDown(t)
+	}
+	return nil, "", err
+}
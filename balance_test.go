@@ -0,0 +1,129 @@
+package sshts
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// namedBackend serves name to every connection and closes it.
+func namedBackend(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startBalancedTestTunnel starts a balanced tunnel on a free port and
+// returns its address once it accepts connections.
+func startBalancedTestTunnel(t *testing.T, s *SSHConn, remotes []string) string {
+	t.Helper()
+	addr := closedAddr(t)
+	go s.StartBalancedTunnel(addr, remotes)
+	eventually(t, "balanced tunnel to listen", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			readBackend(t, conn)
+		}
+		return err == nil
+	})
+	return addr
+}
+
+func readBackend(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	defer conn.Close()
+	name, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(name)
+}
+
+// backendSequence returns which backend served each of n connections.
+func backendSequence(t *testing.T, addr string, n int) []string {
+	t.Helper()
+	var names []string
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, readBackend(t, conn))
+	}
+	return names
+}
+
+func TestBalancedTunnelRoundRobin(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startBalancedTestTunnel(t, s, []string{namedBackend(t, "a"), namedBackend(t, "b")})
+
+	names := backendSequence(t, addr, 6)
+	for i := 1; i < len(names); i++ {
+		if names[i] == names[i-1] {
+			t.Fatalf("connections did not alternate: %v", names)
+		}
+	}
+}
+
+func TestBalancedTunnelSkipsFailedTarget(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	down := closedAddr(t)
+	addr := startBalancedTestTunnel(t, s, []string{namedBackend(t, "a"), down, namedBackend(t, "b")})
+
+	names := backendSequence(t, addr, 6)
+	for i, name := range names {
+		if name == "" {
+			t.Fatalf("connection %d got no backend: %v", i, names)
+		}
+		if i > 0 && name == names[i-1] {
+			t.Fatalf("connections did not alternate over the live targets: %v", names)
+		}
+	}
+}
+
+func TestBalancedTunnelHealthCheck(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	a, b := namedBackend(t, "a"), namedBackend(t, "b")
+	var bDown atomic.Bool
+	bDown.Store(true)
+	s.HealthCheckInterval = 10 * time.Millisecond
+	s.HealthProbe = func(s *SSHConn, addr string) error {
+		if addr == b && bDown.Load() {
+			return ErrRemoteDialFailed
+		}
+		return probeDial(s, addr)
+	}
+	addr := startBalancedTestTunnel(t, s, []string{a, b})
+
+	onlyA := func() bool {
+		for _, name := range backendSequence(t, addr, 4) {
+			if name != "a" {
+				return false
+			}
+		}
+		return true
+	}
+	eventually(t, "target b to be marked down", onlyA)
+
+	bDown.Store(false)
+	eventually(t, "target b to recover", func() bool { return !onlyA() })
+}
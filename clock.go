@@ -0,0 +1,43 @@
+package sshts
+
+import "time"
+
+// clock is the source of time for timeouts, backoffs and health checks, so
+// tests can set SSHConn.clock to a fake one and trigger them without
+// waiting. Read and write deadlines on conns are computed from Now too, but
+// are enforced by the runtime against the real time.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// clk returns the clock of s, the real one unless a test replaced it.
+func (s *SSHConn) clk() clock {
+	if s.clock != nil {
+		return s.clock
+	}
+	return realClock{}
+}
@@ -0,0 +1,170 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c  *fakeClock
+	at time.Time
+	ch chan time.Time
+	f  func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.NewTimer(d).C() }
+func (c *fakeClock) NewTimer(d time.Duration) timer         { return c.add(d, nil) }
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.add(d, f)
+}
+
+func (c *fakeClock) add(d time.Duration, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), ch: make(chan time.Time, 1), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due, pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.f != nil {
+			go t.f()
+		} else {
+			t.ch <- now
+		}
+	}
+}
+
+// waitTimers waits until n timers are pending.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+	eventually(t, "timers to be set", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.timers) >= n
+	})
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestDialTimeoutFakeClock(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetChannelDelay(time.Hour)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	s.DialTimeout = time.Minute
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.dialRemote("tcp", srv.EchoAddr)
+		errs <- err
+	}()
+	clk.waitTimers(t, 1)
+	clk.Advance(time.Minute)
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial did not time out")
+	}
+}
+
+func TestMaxConnectionDurationFakeClock(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	s.MaxConnectionDuration = time.Hour
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "hello")
+	clk.waitTimers(t, 1)
+	clk.Advance(time.Hour)
+	if !refused(conn) {
+		t.Fatal("connection still open after MaxConnectionDuration")
+	}
+}
+
+func TestLimitGracePeriodFakeClock(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	s.MaxConnections = 1
+	s.LimitGracePeriod = time.Minute
+	exceeded := make(chan net.Addr, 1)
+	s.OnLimitExceeded = func(local net.Addr) { exceeded <- local }
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	echo(t, dial(t, addr), "hello")
+	waiting := dial(t, addr)
+	clk.waitTimers(t, 1)
+	select {
+	case <-exceeded:
+		t.Fatal("rejected before the grace period passed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clk.Advance(time.Minute)
+	select {
+	case <-exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not rejected after the grace period")
+	}
+	if !refused(waiting) {
+		t.Fatal("connection over the limit was forwarded")
+	}
+}
@@ -0,0 +1,123 @@
+package sshts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// RunCommand runs cmd on the ssh server in a new session and returns its
+// output. A command exiting non-zero returns its output and an
+// *ssh.ExitError carrying the exit status.
+func (s *SSHConn) RunCommand(cmd string) (stdout, stderr []byte, err error) {
+	return s.RunCommandContext(context.Background(), cmd)
+}
+
+// RunCommandWithEnv is like RunCommand but sets env for the command first.
+// Servers only accept variables allowed by their configuration (OpenSSH
+// AcceptEnv), a rejected one fails the call without running cmd.
+func (s *SSHConn) RunCommandWithEnv(cmd string, env map[string]string) (stdout, stderr []byte, err error) {
+	return s.runCommand(context.Background(), cmd, env)
+}
+
+// RunCommandContext is like RunCommand but kills the remote command and
+// closes the session when ctx is done.
+func (s *SSHConn) RunCommandContext(ctx context.Context, cmd string) (stdout, stderr []byte, err error) {
+	return s.runCommand(ctx, cmd, nil)
+}
+
+// RunCommandWithEnvContext is RunCommandWithEnv with the cancellation of
+// RunCommandContext.
+func (s *SSHConn) RunCommandWithEnvContext(ctx context.Context, cmd string, env map[string]string) (stdout, stderr []byte, err error) {
+	return s.runCommand(ctx, cmd, env)
+}
+
+func (s *SSHConn) runCommand(ctx context.Context, cmd string, env map[string]string) (stdout, stderr []byte, err error) {
+	session, err := s.newSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := session.Setenv(name, env[name]); err != nil {
+			return nil, nil, fmt.Errorf("server refused environment variable %s: %v", name, err)
+		}
+	}
+
+	var outBuf, errBuf bytes.Buffer
+	session.Stdout = &outBuf
+	session.Stderr = &errBuf
+
+	err = s.runSession(ctx, session, cmd)
+	return outBuf.Bytes(), errBuf.Bytes(), err
+}
+
+// StreamCommand runs cmd on the ssh server and writes its output to stdout
+// and stderr as it arrives, e.g. to tail a remote log. It returns when the
+// command exits, or kills it when ctx is done. Either writer may be nil to
+// discard that stream.
+func (s *SSHConn) StreamCommand(ctx context.Context, cmd string, stdout, stderr io.Writer) error {
+	session, err := s.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return s.runSession(ctx, session, cmd)
+}
+
+func (s *SSHConn) newSession() (*ssh.Session, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh session: %v", err)
+	}
+	s.mu.Lock()
+	forwardAgent := s.agentForwarding
+	s.mu.Unlock()
+	if forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to request agent forwarding: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// runSession runs cmd on session, stopping it when ctx is done.
+func (s *SSHConn) runSession(ctx context.Context, session *ssh.Session, cmd string) error {
+	if err := session.Start(cmd); err != nil {
+		return fmt.Errorf("failed to start command: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		return ctx.Err()
+	}
+}
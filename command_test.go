@@ -0,0 +1,155 @@
+package sshts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunCommand(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	stdout, stderr, err := s.RunCommand("echo hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "hello world\n" || len(stderr) != 0 {
+		t.Fatalf("stdout %q stderr %q", stdout, stderr)
+	}
+
+	_, stderr, err = s.RunCommand("echoerr oops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stderr) != "oops\n" {
+		t.Fatalf("stderr %q, want oops", stderr)
+	}
+}
+
+func TestRunCommandExitStatus(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	_, _, err := s.RunCommand("exit 3")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("got %v, want exit status 3", err)
+	}
+}
+
+func TestRunCommandNotConnected(t *testing.T) {
+	s := newTestConn(t, newTestServer(t))
+	if _, _, err := s.RunCommand("echo"); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v, want ErrNotConnected", err)
+	}
+}
+
+func TestRunCommandContextCancel(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := s.RunCommandContext(ctx, "sleep")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("command stopped after %v", d)
+	}
+}
+
+func TestRunCommandWithEnv(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	stdout, _, err := s.RunCommandWithEnv("printenv LANG APP_MODE", map[string]string{
+		"LANG":     "C.UTF-8",
+		"APP_MODE": "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "C.UTF-8\ntest\n" {
+		t.Fatalf("stdout %q", stdout)
+	}
+
+	// the server refuses LD_ variables, the command does not run
+	_, _, err = s.RunCommandWithEnv("echo ran", map[string]string{"LD_PRELOAD": "x.so"})
+	if err == nil || !strings.Contains(err.Error(), "LD_PRELOAD") {
+		t.Fatalf("got %v, want the refused variable named", err)
+	}
+}
+
+func TestRunCommandWithEnvContext(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	stdout, _, err := s.RunCommandWithEnvContext(context.Background(), "printenv APP_MODE", map[string]string{"APP_MODE": "ctx"})
+	if err != nil || string(stdout) != "ctx\n" {
+		t.Fatalf("stdout %q, err %v", stdout, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = s.RunCommandWithEnvContext(ctx, "sleep", map[string]string{"APP_MODE": "ctx"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestStreamCommand(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StreamCommand(ctx, "follow started", pw, nil)
+		pw.Close()
+	}()
+
+	// the line arrives while the command is still running
+	line, err := bufio.NewReader(pr).ReadString('\n')
+	if err != nil || line != "started\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("command returned %v before cancel", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamCommand did not return after cancel")
+	}
+}
+
+func TestStreamCommandExit(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+
+	var stdout, stderr bytes.Buffer
+	if err := s.StreamCommand(context.Background(), "echo out", &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.Len() != 0 {
+		t.Fatalf("stdout %q stderr %q", stdout.String(), stderr.String())
+	}
+	if err := s.StreamCommand(context.Background(), "echoerr err", nil, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != "err\n" {
+		t.Fatalf("stderr %q, want err", stderr.String())
+	}
+}
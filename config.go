@@ -0,0 +1,286 @@
+package sshts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config describes a connection and its forwards declaratively, so tunnels
+// can be set up from a file or the environment without code changes.
+//
+//	{
+//	  "user": "deploy",
+//	  "key_file": "/etc/sshts/id_ed25519",
+//	  "server": "bastion:22",
+//	  "known_hosts_file": "/etc/sshts/known_hosts",
+//	  "forwards": ["L15432:localhost:5432", "D1080"],
+//	  "max_connections": 100,
+//	  "connect_retries": 5,
+//	  "connect_retry_backoff": "1s"
+//	}
+//
+// Without a key file the keys of the ssh agent are used. Without a
+// known_hosts file any host key is accepted, like New does. Like
+// SSHConn.MaxConnections, max_connections 0 refuses every connection and a
+// negative value means no limit; the loaders default it to Unlimited.
+type Config struct {
+	User           string   `json:"user"`
+	KeyFile        string   `json:"key_file"`
+	Server         string   `json:"server"`
+	KnownHostsFile string   `json:"known_hosts_file"`
+	Forwards       []string `json:"forwards"`
+
+	MaxConnections      int      `json:"max_connections"`
+	MaxConcurrentDials  int      `json:"max_concurrent_dials"`
+	ConnectRetries      int      `json:"connect_retries"`
+	ConnectRetryBackoff Duration `json:"connect_retry_backoff"`
+}
+
+// Duration is a time.Duration written as a string like "1.5s" in json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfigFromFile reads a json Config from path, then applies any
+// SSHTS_* environment variables on top, see ApplyEnv.
+func LoadConfigFromFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %v", err)
+	}
+	c := &Config{MaxConnections: Unlimited}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %v", path, err)
+	}
+	if err := c.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadConfigFromEnv builds a Config from SSHTS_* environment variables only.
+func LoadConfigFromEnv() (*Config, error) {
+	c := &Config{MaxConnections: Unlimited}
+	if err := c.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides fields with the environment variables that are set:
+// SSHTS_USER, SSHTS_KEY_FILE, SSHTS_SERVER, SSHTS_KNOWN_HOSTS_FILE,
+// SSHTS_FORWARDS (comma separated), SSHTS_MAX_CONNECTIONS,
+// SSHTS_MAX_CONCURRENT_DIALS, SSHTS_CONNECT_RETRIES and
+// SSHTS_CONNECT_RETRY_BACKOFF.
+func (c *Config) ApplyEnv() error {
+	strs := map[string]*string{
+		"SSHTS_USER":             &c.User,
+		"SSHTS_KEY_FILE":         &c.KeyFile,
+		"SSHTS_SERVER":           &c.Server,
+		"SSHTS_KNOWN_HOSTS_FILE": &c.KnownHostsFile,
+	}
+	for name, field := range strs {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	ints := map[string]*int{
+		"SSHTS_MAX_CONNECTIONS":      &c.MaxConnections,
+		"SSHTS_MAX_CONCURRENT_DIALS": &c.MaxConcurrentDials,
+		"SSHTS_CONNECT_RETRIES":      &c.ConnectRetries,
+	}
+	for name, field := range ints {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = n
+		}
+	}
+
+	if v, ok := os.LookupEnv("SSHTS_CONNECT_RETRY_BACKOFF"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid SSHTS_CONNECT_RETRY_BACKOFF: %v", err)
+		}
+		c.ConnectRetryBackoff = Duration(d)
+	}
+	if v, ok := os.LookupEnv("SSHTS_FORWARDS"); ok {
+		c.Forwards = nil
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				c.Forwards = append(c.Forwards, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the config is complete and consistent, reporting
+// every problem found rather than just the first.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.User == "" {
+		errs = append(errs, fmt.Errorf("user is required"))
+	}
+	if c.Server == "" {
+		errs = append(errs, fmt.Errorf("server is required"))
+	} else if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		errs = append(errs, fmt.Errorf("server %q must be host:port: %v", c.Server, err))
+	}
+	if c.KeyFile == "" && os.Getenv("SSH_AUTH_SOCK") == "" {
+		errs = append(errs, fmt.Errorf("no auth method: set key_file or run an ssh agent"))
+	}
+	for _, spec := range c.Forwards {
+		if _, _, _, err := parseForward(spec); err != nil {
+			errs = append(errs, fmt.Errorf("forward %q: %v", spec, err))
+		}
+	}
+	if c.MaxConcurrentDials < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrent_dials must not be negative"))
+	}
+	if c.ConnectRetries < 0 {
+		errs = append(errs, fmt.Errorf("connect_retries must not be negative"))
+	}
+	if c.ConnectRetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("connect_retry_backoff must not be negative"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
+
+// New validates the config and creates an SSHConn from it, it is not
+// connected yet.
+func (c *Config) New() (*SSHConn, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var auth ssh.AuthMethod
+	var agentKeys *agentSigners
+	if c.KeyFile != "" {
+		key, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private key: %v", err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		var err error
+		if auth, agentKeys, err = agentAuth(); err != nil {
+			return nil, err
+		}
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if c.KnownHostsFile != "" {
+		var err error
+		if hostKeyCallback, err = KnownHostsCallback(c.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("unable to read known_hosts: %v", err)
+		}
+	}
+
+	s := newSSHConn(c.User, c.Server, []ssh.AuthMethod{auth}, hostKeyCallback)
+	s.agentKeys = agentKeys
+	s.MaxConnections = c.MaxConnections
+	s.MaxConcurrentDials = c.MaxConcurrentDials
+	s.ConnectRetries = c.ConnectRetries
+	s.ConnectRetryBackoff = time.Duration(c.ConnectRetryBackoff)
+	s.config = c
+	return s, nil
+}
+
+// Start creates the SSHConn, connects and starts all configured forwards.
+func (c *Config) Start() (*SSHConn, error) {
+	s, err := c.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Connect(); err != nil {
+		return nil, err
+	}
+	if err := s.StartForwards(c.Forwards); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload applies c to an SSHConn created from a Config, e.g. on SIGHUP.
+// MaxConnections, MaxConcurrentDials, ConnectRetries and
+// ConnectRetryBackoff take effect for new connections without dropping
+// existing ones. If User, KeyFile, Server or KnownHostsFile changed the
+// server is dialed again as Reconnect does. Forwards are not restarted.
+func (s *SSHConn) Reload(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old := s.config
+	s.mu.Unlock()
+
+	redial := old == nil || c.User != old.User || c.KeyFile != old.KeyFile ||
+		c.Server != old.Server || c.KnownHostsFile != old.KnownHostsFile
+	var fresh *SSHConn
+	if redial {
+		if s.borrowed {
+			return fmt.Errorf("cannot reload the server of a borrowed ssh client")
+		}
+		var err error
+		if fresh, err = c.New(); err != nil {
+			return err
+		}
+	}
+
+	s.SetMaxConnections(c.MaxConnections)
+	s.mu.Lock()
+	s.MaxConcurrentDials = c.MaxConcurrentDials
+	s.ConnectRetries = c.ConnectRetries
+	s.ConnectRetryBackoff = time.Duration(c.ConnectRetryBackoff)
+	s.config = c
+	var oldAgent *agentSigners
+	if fresh != nil {
+		s.sshConf = fresh.sshConf
+		s.serverAddr = fresh.serverAddr
+		oldAgent, s.agentKeys = s.agentKeys, fresh.agentKeys
+	}
+	s.mu.Unlock()
+
+	if fresh != nil {
+		err := s.Reconnect()
+		if oldAgent != nil {
+			oldAgent.Close()
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package sshts
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kslamph/sshts/testutil"
+)
+
+func TestConfigValidate(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	valid := Config{User: "deploy", KeyFile: "id_ed25519", Server: "bastion:22", Forwards: []string{"L15432:localhost:5432"}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	unlimited := valid
+	unlimited.MaxConnections = Unlimited
+	if err := unlimited.Validate(); err != nil {
+		t.Fatalf("config without a connection limit: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"missing user", func(c *Config) { c.User = "" }, "user is required"},
+		{"no auth", func(c *Config) { c.KeyFile = "" }, "no auth method"},
+		{"bad server address", func(c *Config) { c.Server = "bastion" }, "must be host:port"},
+		{"bad forward", func(c *Config) { c.Forwards = []string{"L15432"} }, `forward "L15432"`},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.change(&c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConfigValidateReportsAll(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	err := (&Config{Server: "bastion"}).Validate()
+	if err == nil {
+		t.Fatal("empty config accepted")
+	}
+	for _, want := range []string{"user is required", "no auth method", "must be host:port"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from %v", want, err)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sshts.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"user": "deploy",
+		"key_file": "/etc/sshts/id_ed25519",
+		"server": "bastion:22",
+		"known_hosts_file": "/etc/sshts/known_hosts",
+		"forwards": ["L15432:localhost:5432", "D1080"],
+		"max_connections": 100,
+		"max_concurrent_dials": 4,
+		"connect_retries": 5,
+		"connect_retry_backoff": "1.5s"
+	}`)
+	c, err := LoadConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		User:                "deploy",
+		KeyFile:             "/etc/sshts/id_ed25519",
+		Server:              "bastion:22",
+		KnownHostsFile:      "/etc/sshts/known_hosts",
+		Forwards:            []string{"L15432:localhost:5432", "D1080"},
+		MaxConnections:      100,
+		MaxConcurrentDials:  4,
+		ConnectRetries:      5,
+		ConnectRetryBackoff: Duration(1500 * time.Millisecond),
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadConfigMaxConnections(t *testing.T) {
+	for data, want := range map[string]int{
+		`{"user": "deploy"}`:                        Unlimited,
+		`{"user": "deploy", "max_connections": 0}`:  0,
+		`{"user": "deploy", "max_connections": -1}`: Unlimited,
+	} {
+		c, err := LoadConfigFromFile(writeConfig(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.MaxConnections != want {
+			t.Errorf("%s: max connections %d, want %d", data, c.MaxConnections, want)
+		}
+	}
+	c, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MaxConnections != Unlimited {
+		t.Errorf("max connections %d from an empty environment, want Unlimited", c.MaxConnections)
+	}
+}
+
+func TestLoadConfigFromFileInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"user": `,
+		`{"connect_retry_backoff": 5}`,
+		`{"connect_retry_backoff": "soon"}`,
+	} {
+		if _, err := LoadConfigFromFile(writeConfig(t, data)); err == nil {
+			t.Errorf("%s: parsed without error", data)
+		}
+	}
+	if _, err := LoadConfigFromFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file loaded without error")
+	}
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, `{"user": "deploy", "server": "bastion:22", "forwards": ["D1080"], "max_connections": 100}`)
+	t.Setenv("SSHTS_SERVER", "other:2222")
+	t.Setenv("SSHTS_FORWARDS", "L8080:web:80, R9090:localhost:90,")
+	t.Setenv("SSHTS_MAX_CONNECTIONS", "7")
+	t.Setenv("SSHTS_CONNECT_RETRY_BACKOFF", "250ms")
+
+	c, err := LoadConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != "deploy" {
+		t.Errorf("user %q, the file's value should be kept", c.User)
+	}
+	if c.Server != "other:2222" || c.MaxConnections != 7 || c.ConnectRetryBackoff != Duration(250*time.Millisecond) {
+		t.Errorf("env not applied: %+v", c)
+	}
+	if want := []string{"L8080:web:80", "R9090:localhost:90"}; !reflect.DeepEqual(c.Forwards, want) {
+		t.Errorf("forwards %q, want %q", c.Forwards, want)
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	for name, value := range map[string]string{
+		"SSHTS_MAX_CONNECTIONS":       "many",
+		"SSHTS_CONNECT_RETRIES":       "1.5",
+		"SSHTS_CONNECT_RETRY_BACKOFF": "5",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			_, err := LoadConfigFromEnv()
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Fatalf("got %v, want an error naming %s", err, name)
+			}
+		})
+	}
+}
+
+// newConfigConn returns an SSHConn for srv created from a Config.
+func newConfigConn(t *testing.T, srv *testutil.Server) (*SSHConn, *Config) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, srv.ClientKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{User: "test", KeyFile: keyFile, Server: srv.Addr, MaxConnections: Unlimited}
+	s, err := c.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Logger = log.New(io.Discard, "", 0)
+	t.Cleanup(func() { s.Close() })
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// Run with -race: Reload changes the settings while Reconnect reads them.
+func TestReloadLimits(t *testing.T) {
+	srv := newTestServer(t)
+	s, c := newConfigConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	reloaded := *c
+	reloaded.MaxConnections = 1
+	reloaded.MaxConcurrentDials = 1
+	reloaded.ConnectRetries = 2
+	reloaded.ConnectRetryBackoff = Duration(time.Millisecond)
+	reconnected := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if err := s.Reconnect(); err != nil {
+				reconnected <- err
+				return
+			}
+		}
+		reconnected <- nil
+	}()
+	for i := 0; i < 10; i++ {
+		reloaded.ConnectRetries = i
+		if err := s.Reload(&reloaded); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := <-reconnected; err != nil {
+		t.Fatal(err)
+	}
+
+	first := dial(t, addr)
+	echo(t, first, "within the limit")
+	if !refused(dial(t, addr)) {
+		t.Fatal("connection over the reloaded MaxConnections was forwarded")
+	}
+	if s.Client() == nil {
+		t.Fatal("reloading limits dropped the ssh connection")
+	}
+	echo(t, first, "kept across the reload")
+
+	reloaded.MaxConnections = 2
+	if err := s.Reload(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, dial(t, addr), "raised limit")
+}
+
+func TestReloadServer(t *testing.T) {
+	srv := newTestServer(t)
+	s, c := newConfigConn(t, srv)
+
+	other := newTestServer(t)
+	keyFile := filepath.Join(t.TempDir(), "other")
+	if err := os.WriteFile(keyFile, other.ClientKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := *c
+	reloaded.Server = other.Addr
+	reloaded.KeyFile = keyFile
+	if err := s.Reload(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Client().RemoteAddr().String(); got != other.Addr {
+		t.Fatalf("connected to %s after reload, want %s", got, other.Addr)
+	}
+
+	reloaded.Server = "bastion"
+	if err := s.Reload(&reloaded); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+}
@@ -0,0 +1,147 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes a connection being forwarded by a local tunnel.
+type ConnInfo struct {
+	ID       string
+	Client   net.Addr
+	Remote   string
+	Started  time.Time
+	BytesIn  int64
+	BytesOut int64
+
+	// Wait is how long the connection waited for a MaxConnections slot,
+	// Dial how long opening the remote side took and FirstByte the time
+	// from then until the first data came back. They are 0 until known.
+	Wait      time.Duration
+	Dial      time.Duration
+	FirstByte time.Duration
+}
+
+type connEntry struct {
+	id       string
+	client   net.Addr
+	started  time.Time
+	conn     net.Conn
+	counters byteCounters
+
+	mu        sync.Mutex
+	remote    string
+	wait      time.Duration
+	dial      time.Duration
+	firstByte time.Duration
+}
+
+func (e *connEntry) setRemote(remote string) {
+	e.mu.Lock()
+	e.remote = remote
+	e.mu.Unlock()
+}
+
+// setDuration sets one of the timings of e.
+func (e *connEntry) setDuration(field *time.Duration, d time.Duration) {
+	e.mu.Lock()
+	*field = d
+	e.mu.Unlock()
+}
+
+func (e *connEntry) info() ConnInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return ConnInfo{
+		ID:        e.id,
+		Client:    e.client,
+		Remote:    e.remote,
+		Started:   e.started,
+		BytesIn:   e.counters.bytesIn.Load(),
+		BytesOut:  e.counters.bytesOut.Load(),
+		Wait:      e.wait,
+		Dial:      e.dial,
+		FirstByte: e.firstByte,
+	}
+}
+
+// Connections lists the connections local tunnels are forwarding now.
+func (s *SSHConn) Connections() []ConnInfo {
+	s.mu.Lock()
+	entries := make([]*connEntry, 0, len(s.connEntries))
+	for _, e := range s.connEntries {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e.info())
+	}
+	return infos
+}
+
+// KillConnection closes the forwarded connection with the given ID, as
+// reported by Connections, leaving the others alone.
+func (s *SSHConn) KillConnection(id string) error {
+	s.mu.Lock()
+	e, ok := s.connEntries[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no connection with id %s", id)
+	}
+	return e.conn.Close()
+}
+
+func (s *SSHConn) addConnEntry(conn net.Conn) *connEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextConnID++
+	id := strconv.FormatUint(s.nextConnID, 10)
+	if s.ConnectionIDFunc != nil {
+		custom := s.ConnectionIDFunc(conn.RemoteAddr())
+		if _, taken := s.connEntries[custom]; taken {
+			custom += "-" + id
+		}
+		id = custom
+	}
+	e := &connEntry{
+		id:      id,
+		client:  conn.RemoteAddr(),
+		started: s.clk().Now(),
+		conn:    conn,
+	}
+	if s.connEntries == nil {
+		s.connEntries = make(map[string]*connEntry)
+	}
+	s.connEntries[e.id] = e
+	return e
+}
+
+func (s *SSHConn) removeConnEntry(e *connEntry) {
+	s.mu.Lock()
+	delete(s.connEntries, e.id)
+	s.mu.Unlock()
+}
+
+// firstByteConn calls read the first time data is read from it.
+type firstByteConn struct {
+	net.Conn
+	once sync.Once
+	read func()
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.once.Do(c.read)
+	}
+	return n, err
+}
+
+func (c *firstByteConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,154 @@
+package sshts
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionsAndKill(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	first, second := dial(t, addr), dial(t, addr)
+	echo(t, first, "hello")
+	echo(t, second, "hi")
+
+	infos := s.Connections()
+	if len(infos) != 2 {
+		t.Fatalf("%d connections listed, want 2", len(infos))
+	}
+	var firstInfo ConnInfo
+	for _, info := range infos {
+		if info.Remote != srv.EchoAddr {
+			t.Errorf("remote %q, want %s", info.Remote, srv.EchoAddr)
+		}
+		if info.Started.IsZero() {
+			t.Error("start time not set")
+		}
+		if info.Client.String() == first.LocalAddr().String() {
+			firstInfo = info
+		}
+	}
+	if firstInfo.ID == "" {
+		t.Fatalf("first connection not listed: %+v", infos)
+	}
+	if firstInfo.BytesOut != 5 || firstInfo.BytesIn != 5 {
+		t.Fatalf("counted %d bytes out and %d in, want 5 and 5", firstInfo.BytesOut, firstInfo.BytesIn)
+	}
+
+	if err := s.KillConnection(firstInfo.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !refused(first) {
+		t.Fatal("killed connection still forwards")
+	}
+	echo(t, second, "still open")
+	eventually(t, "killed connection to be unlisted", func() bool { return len(s.Connections()) == 1 })
+
+	if err := s.KillConnection("no such id"); err == nil {
+		t.Fatal("killing an unknown id succeeded")
+	}
+}
+
+func TestConnectionIDFunc(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.ConnectionIDFunc = func(local net.Addr) string { return "web" }
+	connected := make(chan ConnInfo, 2)
+	disconnected := make(chan ConnInfo, 2)
+	s.OnConnect = func(info ConnInfo) { connected <- info }
+	s.OnDisconnect = func(info ConnInfo, err error) { disconnected <- info }
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	next := func(ch chan ConnInfo, what string) ConnInfo {
+		t.Helper()
+		select {
+		case info := <-ch:
+			return info
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s callback", what)
+			return ConnInfo{}
+		}
+	}
+
+	first := dial(t, addr)
+	echo(t, first, "hello")
+	info := next(connected, "OnConnect")
+	if info.ID != "web" || info.Client.String() != first.LocalAddr().String() {
+		t.Fatalf("OnConnect got %s from %s, want web from %s", info.ID, info.Client, first.LocalAddr())
+	}
+
+	// an ID in use gets the connection number appended
+	second := dial(t, addr)
+	echo(t, second, "hello")
+	if info := next(connected, "OnConnect"); info.ID != "web-2" {
+		t.Fatalf("second connection got ID %s, want web-2", info.ID)
+	}
+
+	first.Close()
+	if info := next(disconnected, "OnDisconnect"); info.ID != "web" {
+		t.Fatalf("OnDisconnect got ID %s, want web", info.ID)
+	}
+}
+
+func TestConnectionTimings(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	srv.HoldChannels()
+	defer srv.ReleaseChannels()
+	conn := dial(t, addr)
+	eventually(t, "the channel open to reach the server", func() bool { return srv.MaxConcurrentOpens() == 1 })
+	clk.Advance(2 * time.Second)
+	srv.ReleaseChannels()
+
+	var info ConnInfo
+	eventually(t, "the dial to finish", func() bool {
+		infos := s.Connections()
+		if len(infos) == 1 {
+			info = infos[0]
+		}
+		return info.Dial != 0
+	})
+	if info.Dial != 2*time.Second || info.FirstByte != 0 {
+		t.Fatalf("dial %v and first byte %v, want 2s and 0", info.Dial, info.FirstByte)
+	}
+
+	clk.Advance(3 * time.Second)
+	echo(t, conn, "hello")
+	clk.Advance(time.Hour)
+	echo(t, conn, "again")
+	info = s.Connections()[0]
+	if info.Dial != 2*time.Second || info.FirstByte != 3*time.Second {
+		t.Fatalf("dial %v and first byte %v, want 2s and 3s", info.Dial, info.FirstByte)
+	}
+}
+
+func TestFirstByteConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	reads := 0
+	c := &firstByteConn{Conn: local, read: func() { reads++ }}
+
+	go func() {
+		remote.Write(nil)
+		remote.Write([]byte("ab"))
+		remote.Write([]byte("cd"))
+	}()
+	buf := make([]byte, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("read called %d times, want once", reads)
+	}
+}
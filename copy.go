@@ -0,0 +1,134 @@
+package sshts
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBufferSize     = 32 * 1024
+	minAdaptiveBufferSize = 4 * 1024
+)
+
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = map[int]*sync.Pool{}
+)
+
+// bufferPool returns the pool of buffers of the given size, shared by all
+// connections using that size.
+func bufferPool(size int) *sync.Pool {
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	p, ok := bufferPools[size]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}}
+		bufferPools[size] = p
+	}
+	return p
+}
+
+func bufferSize(size, fallback int) int {
+	if size > 0 {
+		return size
+	}
+	if fallback > 0 {
+		return fallback
+	}
+	return defaultBufferSize
+}
+
+// uploadBufferSize is the buffer used for data sent from the local side.
+func (s *SSHConn) uploadBufferSize() int {
+	return bufferSize(s.UploadBufferSize, s.BufferSize)
+}
+
+// downloadBufferSize is the buffer used for data received through ssh.
+func (s *SSHConn) downloadBufferSize() int {
+	return bufferSize(s.DownloadBufferSize, s.BufferSize)
+}
+
+// copyData copies src to dst until EOF or an error, adding the bytes
+// written to the counters. With ReadTimeout or WriteTimeout set every read
+// and write gets a fresh deadline, on conns that support them. Between two
+// tcp conns, with no timeouts, adaptive buffers or quota, the runtime
+// splices instead, on linux.
+func (s *SSHConn) copyData(dst, src io.ReadWriteCloser, size int, total, conn *atomic.Int64) error {
+	if s.ReadTimeout <= 0 && s.WriteTimeout <= 0 && !s.AdaptiveBuffers && s.MaxTotalBytes <= 0 {
+		if dstTCP, srcTCP := tcpConn(dst), tcpConn(src); dstTCP != nil && srcTCP != nil {
+			// let the runtime splice between the sockets without copying
+			// through user space, the counters are updated at the end
+			n, err := dstTCP.ReadFrom(srcTCP)
+			total.Add(n)
+			conn.Add(n)
+			return err
+		}
+	}
+
+	maxSize := size
+	if s.AdaptiveBuffers && size > minAdaptiveBufferSize {
+		size = minAdaptiveBufferSize
+	}
+	bp := bufferPool(size).Get().(*[]byte)
+	defer func() { bufferPool(len(*bp)).Put(bp) }()
+	buf := *bp
+
+	w := &countingWriter{w: dst, n: total, conn: conn}
+	if s.MaxTotalBytes > 0 {
+		w.written = s.checkQuota
+	}
+	if s.ReadTimeout <= 0 && s.WriteTimeout <= 0 && !s.AdaptiveBuffers {
+		_, err := io.CopyBuffer(w, src, buf)
+		return err
+	}
+
+	for {
+		if s.ReadTimeout > 0 {
+			if d, ok := src.(interface{ SetReadDeadline(time.Time) error }); ok {
+				d.SetReadDeadline(s.clk().Now().Add(s.ReadTimeout))
+			}
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if s.WriteTimeout > 0 {
+				if d, ok := dst.(interface{ SetWriteDeadline(time.Time) error }); ok {
+					d.SetWriteDeadline(s.clk().Now().Add(s.WriteTimeout))
+				}
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if s.AdaptiveBuffers && n == len(buf) && len(buf) < maxSize {
+			// the buffer was filled, move to a larger one for bulk data
+			bufferPool(len(buf)).Put(bp)
+			size = len(buf) * 2
+			if size > maxSize {
+				size = maxSize
+			}
+			bp = bufferPool(size).Get().(*[]byte)
+			buf = *bp
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tcpConn returns the *net.TCPConn behind c, or nil.
+func tcpConn(c io.ReadWriteCloser) *net.TCPConn {
+	if t, ok := c.(*trackedConn); ok {
+		c = t.Conn
+	}
+	tc, _ := c.(*net.TCPConn)
+	return tc
+}
@@ -0,0 +1,308 @@
+package sshts
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readSizeConn returns data once then EOF, recording the size of the
+// buffers it is read into. Writes are discarded.
+type readSizeConn struct {
+	mu    sync.Mutex
+	data  []byte
+	sizes []int
+}
+
+func (c *readSizeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes = append(c.sizes, len(p))
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *readSizeConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *readSizeConn) Close() error                { return nil }
+
+func (c *readSizeConn) readSizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sizes
+}
+
+func TestBufferSizePerDirection(t *testing.T) {
+	s := &SSHConn{UploadBufferSize: 1000, DownloadBufferSize: 3000}
+	local := &readSizeConn{data: []byte("upload")}
+	remote := &readSizeConn{data: []byte("download")}
+	in, out := s.pipe(local, remote, nil)
+	if in != int64(len("download")) || out != int64(len("upload")) {
+		t.Fatalf("%d bytes in and %d out", in, out)
+	}
+	for _, n := range local.readSizes() {
+		if n != 1000 {
+			t.Fatalf("local side read into %d byte buffers, want UploadBufferSize", n)
+		}
+	}
+	for _, n := range remote.readSizes() {
+		if n != 3000 {
+			t.Fatalf("remote side read into %d byte buffers, want DownloadBufferSize", n)
+		}
+	}
+}
+
+func TestBufferSizeFallback(t *testing.T) {
+	s := &SSHConn{BufferSize: 2000, DownloadBufferSize: 3000}
+	if n := s.uploadBufferSize(); n != 2000 {
+		t.Fatalf("upload buffer %d, want BufferSize", n)
+	}
+	if n := s.downloadBufferSize(); n != 3000 {
+		t.Fatalf("download buffer %d, want DownloadBufferSize", n)
+	}
+	if n := (&SSHConn{}).uploadBufferSize(); n != defaultBufferSize {
+		t.Fatalf("default buffer %d, want %d", n, defaultBufferSize)
+	}
+}
+
+// chunkConn returns n bytes in reads of at most chunk bytes, recording the
+// largest buffer it is read into. Writes are discarded.
+type chunkConn struct {
+	n, chunk int
+	maxBuf   int
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	if len(p) > c.maxBuf {
+		c.maxBuf = len(p)
+	}
+	if c.n == 0 {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > c.chunk {
+		n = c.chunk
+	}
+	if n > c.n {
+		n = c.n
+	}
+	c.n -= n
+	return n, nil
+}
+
+func (c *chunkConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *chunkConn) Close() error                { return nil }
+
+func TestAdaptiveBuffers(t *testing.T) {
+	s := &SSHConn{AdaptiveBuffers: true, BufferSize: 64 * 1024}
+	var total, conn atomic.Int64
+
+	bulk := &chunkConn{n: 1 << 20, chunk: 1 << 20}
+	if err := s.copyData(&chunkConn{}, bulk, s.uploadBufferSize(), &total, &conn); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.maxBuf != 64*1024 {
+		t.Fatalf("bulk transfer grew to %d byte buffers, want BufferSize", bulk.maxBuf)
+	}
+
+	chatty := &chunkConn{n: 1 << 20, chunk: 100}
+	if err := s.copyData(&chunkConn{}, chatty, s.uploadBufferSize(), &total, &conn); err != nil {
+		t.Fatal(err)
+	}
+	if chatty.maxBuf != minAdaptiveBufferSize {
+		t.Fatalf("chatty transfer used %d byte buffers, want %d", chatty.maxBuf, minAdaptiveBufferSize)
+	}
+}
+
+// BenchmarkAdaptiveBuffers copies bulk and chatty streams with fixed
+// buffers of the smallest and largest size and with adaptive ones,
+// reporting the largest buffer each held.
+func BenchmarkAdaptiveBuffers(b *testing.B) {
+	const size = 256 * 1024
+	modes := []struct {
+		name string
+		s    *SSHConn
+	}{
+		{"fixed-4KB", &SSHConn{BufferSize: minAdaptiveBufferSize}},
+		{"fixed-256KB", &SSHConn{BufferSize: size}},
+		{"adaptive", &SSHConn{BufferSize: size, AdaptiveBuffers: true}},
+	}
+	for _, stream := range []struct {
+		name  string
+		chunk int
+	}{{"bulk", 1 << 20}, {"chatty", 512}} {
+		for _, m := range modes {
+			b.Run(stream.name+"/"+m.name, func(b *testing.B) {
+				const n = 8 << 20
+				var total, conn atomic.Int64
+				maxBuf := 0
+				b.SetBytes(n)
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					src := &chunkConn{n: n, chunk: stream.chunk}
+					if err := m.s.copyData(&chunkConn{}, src, m.s.uploadBufferSize(), &total, &conn); err != nil {
+						b.Fatal(err)
+					}
+					maxBuf = src.maxBuf
+				}
+				b.ReportMetric(float64(maxBuf), "buf-bytes")
+			})
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback tcp connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// hiddenConn hides the *net.TCPConn type so copyData uses its buffer.
+type hiddenConn struct{ net.Conn }
+
+// BenchmarkCopyTCP copies between two tcp conns with the splice path and
+// through the pooled buffer.
+func BenchmarkCopyTCP(b *testing.B) {
+	const n = 8 << 20
+	data := make([]byte, n)
+	for _, splice := range []bool{true, false} {
+		name := "buffer"
+		if splice {
+			name = "splice"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := &SSHConn{}
+			var total, conn atomic.Int64
+			b.SetBytes(n)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				srcClient, src := tcpPair(b)
+				dst, dstServer := tcpPair(b)
+				go func() {
+					srcClient.Write(data)
+					srcClient.Close()
+				}()
+				go io.Copy(io.Discard, dstServer)
+				var from, to io.ReadWriteCloser = src, dst
+				if !splice {
+					from, to = hiddenConn{src}, hiddenConn{dst}
+				}
+				b.StartTimer()
+				if err := s.copyData(to, from, defaultBufferSize, &total, &conn); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				src.Close()
+				dst.Close()
+				dstServer.Close()
+			}
+		})
+	}
+}
+
+func TestCopyTCPCounts(t *testing.T) {
+	srcClient, src := tcpPair(t)
+	dst, dstServer := tcpPair(t)
+	defer src.Close()
+	defer dst.Close()
+	defer dstServer.Close()
+	go func() {
+		srcClient.Write([]byte("spliced"))
+		srcClient.Close()
+	}()
+	var total, conn atomic.Int64
+	if err := (&SSHConn{}).copyData(dst, src, defaultBufferSize, &total, &conn); err != nil {
+		t.Fatal(err)
+	}
+	dst.CloseWrite()
+	got, _ := io.ReadAll(dstServer)
+	if string(got) != "spliced" || total.Load() != 7 || conn.Load() != 7 {
+		t.Fatalf("copied %q, counted %d and %d", got, total.Load(), conn.Load())
+	}
+}
+
+// closedByForward waits for the forward to close conn, failing if it is
+// still open after a few seconds, and returns how long that took.
+func closedByForward(t *testing.T, conn net.Conn) time.Duration {
+	t.Helper()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		t.Fatal("connection still open")
+	}
+	return time.Since(start)
+}
+
+func TestReadTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.ReadTimeout = 100 * time.Millisecond
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	// a client that keeps talking is not cut off
+	for i := 0; i < 4; i++ {
+		echo(t, conn, "busy")
+		time.Sleep(50 * time.Millisecond)
+	}
+	if d := closedByForward(t, conn); d < 50*time.Millisecond {
+		t.Fatalf("closed after %v of silence, before ReadTimeout", d)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.WriteTimeout = 100 * time.Millisecond
+
+	// a target that sends forever to a client that never reads
+	flood, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flood.Close()
+	go func() {
+		conn, err := flood.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	addr := startTestTunnel(t, s, flood.Addr().String())
+
+	conn := dial(t, addr)
+	// not reading fills the socket buffers until a write blocks for longer
+	// than WriteTimeout
+	eventually(t, "data to arrive", func() bool { return s.StatsSnapshot().BytesIn > 0 })
+	time.Sleep(time.Second)
+	closedByForward(t, conn)
+}
@@ -0,0 +1,173 @@
+package sshts
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ContextDialer is satisfied by *net.Dialer and can be plugged into
+// http.Transport.DialContext, database drivers or grpc dialers.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type sshDialer struct {
+	s *SSHConn
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.s.DialTargetContext(ctx, network, addr)
+}
+
+// Dialer returns a dialer that opens connections through the ssh server,
+// no local listener is needed.
+//
+//	transport := &http.Transport{DialContext: sshC.Dialer().DialContext}
+func (s *SSHConn) Dialer() ContextDialer {
+	return &sshDialer{s: s}
+}
+
+// DialTarget opens a single connection to addr through the ssh server.
+// addr is resolved on the server side.
+func (s *SSHConn) DialTarget(network, addr string) (net.Conn, error) {
+	return s.DialTargetContext(context.Background(), network, addr)
+}
+
+// DialTargetContext is like DialTarget but returns when ctx is done. A
+// connection that opens after that is closed.
+func (s *SSHConn) DialTargetContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	return s.openChannelContext(ctx, client, network, addr, nil)
+}
+
+// dialRemote opens a channel to addr for a forwarded connection, honouring
+// MaxConcurrentDials and DialTimeout.
+func (s *SSHConn) dialRemote(network, addr string) (net.Conn, error) {
+	return s.dialRemoteContext(context.Background(), network, addr)
+}
+
+// dialRemoteContext is dialRemote giving up once ctx is done.
+func (s *SSHConn) dialRemoteContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkForwardLoop(addr); err != nil {
+		s.stats.rejected.Add(1)
+		return nil, err
+	}
+	if s.DialTimeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		timer := s.clk().AfterFunc(s.DialTimeout, func() { cancel(context.DeadlineExceeded) })
+		defer timer.Stop()
+	}
+
+	var release func()
+	if sem := s.dialSemaphore(); sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			s.stats.dialErrors.Add(1)
+			return nil, fmt.Errorf("dial %s: %w", addr, context.Cause(ctx))
+		}
+		release = func() { <-sem }
+	}
+
+	conn, err := s.openChannelContext(ctx, client, network, addr, release)
+	if err != nil {
+		s.stats.dialErrors.Add(1)
+		if ctx.Err() != nil {
+			err = fmt.Errorf("dial %s: %w", addr, context.Cause(ctx))
+		}
+	}
+	return conn, err
+}
+
+// openChannelContext runs openChannel but returns when ctx is done, closing
+// a channel that opens after that. release, if not nil, is called once the
+// dial itself has finished.
+func (s *SSHConn) openChannelContext(ctx context.Context, client *ssh.Client, network, addr string, release func()) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		if release != nil {
+			release()
+		}
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := s.openChannel(client, network, addr)
+		if release != nil {
+			release()
+		}
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// openChannel dials addr through client. Host names are passed to the ssh
+// server to resolve unless ResolveRemoteLocally is set.
+func (s *SSHConn) openChannel(client *ssh.Client, network, addr string) (net.Conn, error) {
+	target := addr
+	if s.ResolveRemoteLocally {
+		var err error
+		if target, err = resolveLocally(addr); err != nil {
+			return nil, fmt.Errorf("failed to resolve %s locally: %v", addr, err)
+		}
+	}
+	conn, err := client.Dial(network, target)
+	if err != nil {
+		return nil, dialError(addr, err)
+	}
+	return conn, nil
+}
+
+func resolveLocally(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
+
+func (s *SSHConn) dialSemaphore() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxConcurrentDials <= 0 {
+		return nil
+	}
+	if cap(s.dialSem) != s.MaxConcurrentDials {
+		s.dialSem = make(chan struct{}, s.MaxConcurrentDials)
+	}
+	return s.dialSem
+}
@@ -0,0 +1,131 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialerHTTPTransport(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "through ssh")
+	}))
+	defer web.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: s.Dialer().DialContext}}
+	resp, err := client.Get(web.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "through ssh" {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetChannelDelay(50 * time.Millisecond)
+	s := connectTestConn(t, srv)
+	s.MaxConcurrentDials = 2
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			if err := echoErr(conn, "hello"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.MaxConcurrentOpens(); n > 2 {
+		t.Fatalf("%d dials at once, want at most 2", n)
+	}
+}
+
+func TestDialTargetContextCancelDuringOpen(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetChannelDelay(200 * time.Millisecond)
+	s := connectTestConn(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if conn, err := s.DialTargetContext(ctx, "tcp", srv.EchoAddr); !errors.Is(err, context.Canceled) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// the server opens the channel late, the client must close it
+	eventually(t, "channel to open and be closed", func() bool {
+		accepted, open := srv.ChannelCounts()
+		return accepted == 1 && open == 0
+	})
+}
+
+func TestNotConnected(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if _, err := s.DialTarget("tcp", srv.EchoAddr); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("DialTarget before Connect: %v, want ErrNotConnected", err)
+	}
+	if err := s.StartTunnel("127.0.0.1:0", srv.EchoAddr); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("StartTunnel before Connect: %v, want ErrNotConnected", err)
+	}
+
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := s.DialTarget("tcp", srv.EchoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "one-off")
+}
+
+func TestResolveRemoteLocally(t *testing.T) {
+	srv := newTestServer(t)
+	_, port, _ := net.SplitHostPort(srv.EchoAddr)
+	target := net.JoinHostPort("localhost", port)
+	for _, local := range []bool{false, true} {
+		s := connectTestConn(t, srv)
+		s.ResolveRemoteLocally = local
+		conn, err := s.DialTarget("tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "resolved")
+		conn.Close()
+
+		targets := srv.Targets()
+		host, _, _ := net.SplitHostPort(targets[len(targets)-1])
+		if resolved := net.ParseIP(host) != nil; resolved != local {
+			t.Fatalf("server asked for %s with ResolveRemoteLocally %v", host, local)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package sshts
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotConnected is returned when an operation needs a live ssh client.
+	ErrNotConnected = errors.New("ssh client is not connected")
+
+	// ErrRemoteDialFailed means the ssh connection is fine but the server
+	// could not open the channel, usually because the remote target is down
+	// or forwarding is prohibited.
+	ErrRemoteDialFailed = errors.New("remote dial failed")
+
+	// ErrConnectionLost means the ssh connection itself failed.
+	ErrConnectionLost = errors.New("ssh connection lost")
+
+	// ErrClosedByUser is the Reason of an SSHConn stopped by Close.
+	ErrClosedByUser = errors.New("closed by user")
+
+	// ErrQuotaExceeded is the Reason of an SSHConn that reached
+	// MaxTotalBytes.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrCompressionUnsupported is returned by Connect when Compression is
+	// requested, the ssh library has no compression support.
+	ErrCompressionUnsupported = errors.New("ssh compression is not supported")
+
+	errClosing  = errors.New("ssh client is closing")
+	errOverConn = errors.New("cannot dial an ssh connection made over a given conn")
+)
+
+// dialError wraps an error from opening a channel to addr with
+// ErrRemoteDialFailed or ErrConnectionLost, keeping the original error.
+func dialError(addr string, err error) error {
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return fmt.Errorf("%w: %s: %w", ErrRemoteDialFailed, addr, err)
+	}
+	return fmt.Errorf("%w: dial %s: %w", ErrConnectionLost, addr, err)
+}
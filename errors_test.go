@@ -0,0 +1,67 @@
+package sshts
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// closedAddr returns a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestRemoteDialFailedError(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	_, err := s.DialTarget("tcp", closedAddr(t))
+	if !errors.Is(err, ErrRemoteDialFailed) || errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("got %v, want ErrRemoteDialFailed", err)
+	}
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed {
+		t.Fatalf("original error not kept: %v", err)
+	}
+}
+
+func TestRemoteDialFailedInTunnel(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	errs := make(chan error, 1)
+	s.OnDisconnect = func(info ConnInfo, err error) { errs <- err }
+	addr := startTestTunnel(t, s, closedAddr(t))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-errs; !errors.Is(err, ErrRemoteDialFailed) {
+		t.Fatalf("got %v, want ErrRemoteDialFailed", err)
+	}
+	if !errors.Is(s.LastError(), ErrRemoteDialFailed) {
+		t.Fatalf("LastError is %v", s.LastError())
+	}
+}
+
+func TestConnectionLostDialError(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	client := s.Client()
+	client.Close()
+
+	_, err := s.openChannel(client, "tcp", srv.EchoAddr)
+	if !errors.Is(err, ErrConnectionLost) || errors.Is(err, ErrRemoteDialFailed) {
+		t.Fatalf("got %v, want ErrConnectionLost", err)
+	}
+}
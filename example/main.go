@@ -53,7 +53,7 @@ func tunnelexample() {
 
 	go sshC.StartTunnel(localTunnel, remoteTunnel)
 	fmt.Println("press ctrl+c to exit")
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 	fmt.Println("exiting")
@@ -89,13 +89,13 @@ func socks5example() {
 	defer sshC.Close()
 
 	go sshC.StartSocks5Server(socks5Address)
-	for sshC.GetStatus() < 2 {
+	for sshC.GetStatus() < sshts.StatusSocks5Running {
 	}
 
 	httpget()
 
 	fmt.Println("press ctrl+c to exit")
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 	fmt.Println("exiting")
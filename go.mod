@@ -4,10 +4,12 @@ go 1.20
 
 require (
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
+	github.com/pkg/sftp v1.13.5
 	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.6.0
 )
 
 require (
-	golang.org/x/net v0.6.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )
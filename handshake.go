@@ -0,0 +1,32 @@
+package sshts
+
+import "net"
+
+// HandshakeInfo describes the ssh connection as negotiated with the server.
+// The ssh package does not expose the negotiated cipher and MAC, so only
+// the version strings and session ID are reported.
+type HandshakeInfo struct {
+	User          string
+	ClientVersion string
+	ServerVersion string
+	SessionID     []byte
+	RemoteAddr    net.Addr
+	LocalAddr     net.Addr
+}
+
+// ConnectionInfo reports what was negotiated with the server, which helps
+// debugging servers with unusual version strings or algorithms.
+func (s *SSHConn) ConnectionInfo() (*HandshakeInfo, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	return &HandshakeInfo{
+		User:          client.User(),
+		ClientVersion: string(client.ClientVersion()),
+		ServerVersion: string(client.ServerVersion()),
+		SessionID:     client.SessionID(),
+		RemoteAddr:    client.RemoteAddr(),
+		LocalAddr:     client.LocalAddr(),
+	}, nil
+}
@@ -0,0 +1,35 @@
+package sshts
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConnectionInfo(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if _, err := s.ConnectionInfo(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v before Connect, want ErrNotConnected", err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.ConnectionInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ServerVersion != srv.ServerVersion {
+		t.Errorf("server version %q, want %q", info.ServerVersion, srv.ServerVersion)
+	}
+	if !strings.HasPrefix(info.ClientVersion, "SSH-2.0-") {
+		t.Errorf("client version %q", info.ClientVersion)
+	}
+	if info.User != "test" || len(info.SessionID) == 0 {
+		t.Errorf("user %q, session id %x", info.User, info.SessionID)
+	}
+	if info.RemoteAddr.String() != srv.Addr || info.LocalAddr == nil {
+		t.Errorf("remote %s, local %v", info.RemoteAddr, info.LocalAddr)
+	}
+}
@@ -0,0 +1,152 @@
+package sshts
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var knownHostsMu sync.Mutex
+
+// AddKnownHost appends a known_hosts line for host, e.g. "example.com:22",
+// to knownHostsFile, creating the file if needed. The result is accepted by
+// knownhosts.New.
+func AddKnownHost(knownHostsFile, host string, key ssh.PublicKey) error {
+	return appendKnownHost(knownHostsFile, knownhosts.Normalize(host), key)
+}
+
+// AddHashedKnownHost is like AddKnownHost but writes the host name hashed
+// (|1|salt|hash), as ssh does with HashKnownHosts enabled.
+func AddHashedKnownHost(knownHostsFile, host string, key ssh.PublicKey) error {
+	return appendKnownHost(knownHostsFile, knownhosts.HashHostname(knownhosts.Normalize(host)), key)
+}
+
+func appendKnownHost(knownHostsFile, address string, key ssh.PublicKey) error {
+	line := knownhosts.Line([]string{address}, key) + "\n"
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+		return fmt.Errorf("failed to create known_hosts directory: %v", err)
+	}
+	f, err := os.OpenFile(knownHostsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %v", err)
+	}
+	defer f.Close()
+
+	// other processes may be writing too, e.g. ssh itself
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock known_hosts: %v", err)
+	}
+	defer unlockFile(f)
+
+	if _, err := f.WriteString(line); err != nil {
+		return fmt.Errorf("failed to write known_hosts: %v", err)
+	}
+	return nil
+}
+
+// FingerprintRecordingCallback calls record with the host and the SHA256
+// fingerprint of every key presented, then leaves the verdict to inner.
+// It lets every host key be logged for auditing, accepted or not.
+func FingerprintRecordingCallback(inner ssh.HostKeyCallback, record func(host string, fp string)) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		record(hostname, ssh.FingerprintSHA256(key))
+		return inner(hostname, remote, key)
+	}
+}
+
+// PinnedHostKeyCallback accepts a server only if its key has one of the
+// given SHA256 fingerprints, written as ssh-keygen -lf shows them, e.g.
+// "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s". It is an
+// alternative to a known_hosts file for CI and containers.
+func PinnedHostKeyCallback(sha256Fingerprints ...string) ssh.HostKeyCallback {
+	pinned := make(map[string]bool, len(sha256Fingerprints))
+	for _, fp := range sha256Fingerprints {
+		pinned[fp] = true
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		if !pinned[fp] {
+			return fmt.Errorf("host key of %s with fingerprint %s is not pinned", hostname, fp)
+		}
+		return nil
+	}
+}
+
+// CombineHostKeyCallbacks accepts a server if any of callbacks accepts its
+// key, e.g. pinned fingerprints while moving to a known_hosts file. When
+// all reject it, the error of the last one is returned.
+func CombineHostKeyCallbacks(callbacks ...ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := fmt.Errorf("no host key callback to verify %s", hostname)
+		for _, cb := range callbacks {
+			if err = cb(hostname, remote, key); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+// HostCertCheckerCallback accepts a server whose host certificate is signed
+// by one of caPublicKeys, valid now and issued for the host name dialed,
+// like @cert-authority lines in known_hosts. Plain host keys are rejected.
+func HostCertCheckerCallback(caPublicKeys []ssh.PublicKey) ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, ca := range caPublicKeys {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return checker.CheckHostKey
+}
+
+// UnknownHostKeyError is returned by KnownHostsCallback for a server not in
+// the known_hosts files. Line is the known_hosts line to add to trust it,
+// after checking the fingerprint out of band.
+type UnknownHostKeyError struct {
+	Host        string
+	Fingerprint string
+	Line        string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key for %s (%s), add to known_hosts: %s", e.Host, e.Fingerprint, e.Line)
+}
+
+// KnownHostsCallback is like knownhosts.New but reports a server missing
+// from the files as *UnknownHostKeyError, so tooling can offer to add it
+// with errors.As. A changed key is still reported as *knownhosts.KeyError.
+func KnownHostsCallback(files ...string) (ssh.HostKeyCallback, error) {
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			host := knownhosts.Normalize(hostname)
+			return &UnknownHostKeyError{
+				Host:        host,
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Line:        knownhosts.Line([]string{host}, key),
+			}
+		}
+		return err
+	}, nil
+}
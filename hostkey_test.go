@@ -0,0 +1,233 @@
+package sshts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+func TestAddKnownHost(t *testing.T) {
+	for _, add := range []func(string, string, ssh.PublicKey) error{AddKnownHost, AddHashedKnownHost} {
+		file := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+		key := newTestKey(t).PublicKey()
+		if err := add(file, "example.com:22", key); err != nil {
+			t.Fatal(err)
+		}
+		callback, err := knownhosts.New(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := callback("example.com:22", testRemote, key); err != nil {
+			t.Fatalf("written key not accepted: %v", err)
+		}
+		if err := callback("other.com:22", testRemote, key); err == nil {
+			t.Fatal("key accepted for another host")
+		}
+	}
+}
+
+func TestAddHashedKnownHostIsHashed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := AddHashedKnownHost(file, "example.com:22", newTestKey(t).PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "|1|") || strings.Contains(string(data), "example.com") {
+		t.Fatalf("host name not hashed: %s", data)
+	}
+}
+
+func TestAddKnownHostConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	key := newTestKey(t).PublicKey()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := AddKnownHost(file, "example.com:22", key); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 20 {
+		t.Fatalf("%d lines written, want 20", n)
+	}
+	if _, err := knownhosts.New(file); err != nil {
+		t.Fatalf("concurrent writes left a bad file: %v", err)
+	}
+}
+
+func TestPinnedHostKeyCallback(t *testing.T) {
+	key := newTestKey(t).PublicKey()
+	other := newTestKey(t).PublicKey()
+	cb := PinnedHostKeyCallback(ssh.FingerprintSHA256(other), ssh.FingerprintSHA256(key))
+	if err := cb("example.com:22", testRemote, key); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	if err := cb("example.com:22", testRemote, newTestKey(t).PublicKey()); err == nil {
+		t.Fatal("key with another fingerprint accepted")
+	}
+}
+
+func TestFingerprintRecordingCallback(t *testing.T) {
+	srv := newTestServer(t)
+	var host, fp string
+	cb := FingerprintRecordingCallback(ssh.FixedHostKey(srv.HostKey), func(h, f string) {
+		host, fp = h, f
+	})
+	s := NewFromSigner("test", srv.ClientSigner, srv.Addr, cb)
+	s.Logger = log.New(io.Discard, "", 0)
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if host != srv.Addr || fp != ssh.FingerprintSHA256(srv.HostKey) {
+		t.Fatalf("recorded %s %s, want %s %s", host, fp, srv.Addr, ssh.FingerprintSHA256(srv.HostKey))
+	}
+
+	// keys the inner callback rejects are recorded too
+	fp = ""
+	cb = FingerprintRecordingCallback(ssh.FixedHostKey(newTestKey(t).PublicKey()), func(h, f string) { fp = f })
+	s = NewFromSigner("test", srv.ClientSigner, srv.Addr, cb)
+	s.Logger = log.New(io.Discard, "", 0)
+	defer s.Close()
+	if err := s.Connect(); err == nil {
+		t.Fatal("connected with a rejected host key")
+	}
+	if fp != ssh.FingerprintSHA256(srv.HostKey) {
+		t.Fatalf("recorded %q for a rejected key", fp)
+	}
+}
+
+func TestCombineHostKeyCallbacks(t *testing.T) {
+	key := newTestKey(t).PublicKey()
+	first := errors.New("first rejects")
+	last := errors.New("last rejects")
+	reject := func(err error) ssh.HostKeyCallback {
+		return func(string, net.Addr, ssh.PublicKey) error { return err }
+	}
+
+	cb := CombineHostKeyCallbacks(reject(first), PinnedHostKeyCallback(ssh.FingerprintSHA256(key)))
+	if err := cb("example.com:22", testRemote, key); err != nil {
+		t.Fatalf("key accepted by the second callback rejected: %v", err)
+	}
+
+	cb = CombineHostKeyCallbacks(reject(first), reject(last))
+	if err := cb("example.com:22", testRemote, key); err != last {
+		t.Fatalf("got %v, want the last callback's error", err)
+	}
+	if err := CombineHostKeyCallbacks()("example.com:22", testRemote, key); err == nil {
+		t.Fatal("no callbacks accepted the key")
+	}
+}
+
+func TestHostCertCheckerCallback(t *testing.T) {
+	ca := newTestKey(t)
+	hostKey := newTestKey(t).PublicKey()
+	cb := HostCertCheckerCallback([]ssh.PublicKey{ca.PublicKey()})
+	now := time.Now()
+	sign := func(principal string, before time.Time) ssh.PublicKey {
+		cert := &ssh.Certificate{
+			Key:             hostKey,
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{principal},
+			ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(before.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	if err := cb("example.com:22", testRemote, sign("example.com", now.Add(time.Hour))); err != nil {
+		t.Fatalf("valid host cert rejected: %v", err)
+	}
+	if err := cb("example.com:22", testRemote, sign("example.com", now.Add(-time.Minute))); err == nil {
+		t.Fatal("expired host cert accepted")
+	}
+	if err := cb("example.com:22", testRemote, sign("other.com", now.Add(time.Hour))); err == nil {
+		t.Fatal("host cert for another principal accepted")
+	}
+	if err := cb("example.com:22", testRemote, hostKey); err == nil {
+		t.Fatal("plain host key accepted")
+	}
+}
+
+func TestUnknownHostKeyError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := AddKnownHost(file, "other.com:22", newTestKey(t).PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	cb, err := KnownHostsCallback(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newTestKey(t).PublicKey()
+	err = cb("example.com:2222", testRemote, key)
+	var unknown *UnknownHostKeyError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("got %v, want *UnknownHostKeyError", err)
+	}
+	if unknown.Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Fatalf("fingerprint %s, want %s", unknown.Fingerprint, ssh.FingerprintSHA256(key))
+	}
+
+	// the line is what to append to known_hosts
+	_, hosts, lineKey, _, _, err := ssh.ParseKnownHosts([]byte(unknown.Line))
+	if err != nil {
+		t.Fatalf("invalid known_hosts line %q: %v", unknown.Line, err)
+	}
+	if len(hosts) != 1 || hosts[0] != "[example.com]:2222" || !bytes.Equal(lineKey.Marshal(), key.Marshal()) {
+		t.Fatalf("line %q does not name the host and its key", unknown.Line)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(unknown.Line + "\n")
+	f.Close()
+	if cb, err = KnownHostsCallback(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("example.com:2222", testRemote, key); err != nil {
+		t.Fatalf("key rejected after adding the line: %v", err)
+	}
+}
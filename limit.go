@@ -0,0 +1,131 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Unlimited is the MaxConnections value for no limit, the default of the
+// constructors. Any negative value works the same.
+const Unlimited = -1
+
+// acquireSlot reserves one of the MaxConnections slots for a forwarded
+// connection, waiting up to LimitGracePeriod for one to free up. It returns
+// false when no slot could be had.
+func (s *SSHConn) acquireSlot() bool {
+	var timeout <-chan time.Time
+	if s.LimitGracePeriod > 0 {
+		timer := s.clk().NewTimer(s.LimitGracePeriod)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	for {
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			return false
+		}
+		if s.paused {
+			s.mu.Unlock()
+			return false
+		}
+		if s.MaxConnections < 0 || s.active < s.MaxConnections {
+			s.active++
+			s.mu.Unlock()
+			return true
+		}
+		if timeout == nil {
+			s.mu.Unlock()
+			return false
+		}
+		if s.slotFreed == nil {
+			s.slotFreed = make(chan struct{})
+		}
+		freed := s.slotFreed
+		s.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func (s *SSHConn) releaseSlot() {
+	s.mu.Lock()
+	s.active--
+	s.wakeSlotWaiters()
+	s.mu.Unlock()
+}
+
+// wakeSlotWaiters must be called with s.mu held.
+func (s *SSHConn) wakeSlotWaiters() {
+	if s.slotFreed != nil {
+		close(s.slotFreed)
+		s.slotFreed = nil
+	}
+}
+
+// SetMaxConnections changes MaxConnections while tunnels are running.
+// Lowering it below the number of active connections keeps them open and
+// only refuses new ones until usage drops.
+func (s *SSHConn) SetMaxConnections(n int) {
+	s.mu.Lock()
+	s.MaxConnections = n
+	s.wakeSlotWaiters()
+	s.mu.Unlock()
+}
+
+// Pause makes local tunnels refuse every new connection, as if
+// MaxConnections was reached, until Resume is called. Unlike Drain the
+// listeners stay open and connections already forwarded are kept.
+func (s *SSHConn) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.wakeSlotWaiters()
+	s.mu.Unlock()
+}
+
+// Resume undoes Pause.
+func (s *SSHConn) Resume() {
+	s.mu.Lock()
+	s.paused = false
+	s.wakeSlotWaiters()
+	s.mu.Unlock()
+}
+
+func (s *SSHConn) limitExceeded(conn net.Conn) {
+	s.mu.Lock()
+	limit, paused := s.MaxConnections, s.paused
+	s.mu.Unlock()
+	if paused {
+		s.reject(fmt.Errorf("connection from %s rejected, tunnels paused", conn.RemoteAddr()))
+	} else {
+		s.reject(fmt.Errorf("connection from %s rejected, max connections %d reached", conn.RemoteAddr(), limit))
+	}
+	if s.OnLimitExceeded != nil {
+		s.OnLimitExceeded(conn.RemoteAddr())
+	}
+}
+
+// Drain closes all listeners, so no new connections are accepted, but
+// leaves the connections being forwarded and the ssh client running until
+// they finish or Close is called. Tunnels and socks servers return nil
+// and listeners started afterwards stop right away.
+func (s *SSHConn) Drain() {
+	s.mu.Lock()
+	s.draining = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+}
+
+// DrainedConnections is the number of forwarded connections still open,
+// which after Drain is what is left to finish.
+func (s *SSHConn) DrainedConnections() int {
+	return int(s.stats.active.Load())
+}
@@ -0,0 +1,186 @@
+package sshts
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestLimitExceeded(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxConnections = 1
+	exceeded := make(chan net.Addr, 1)
+	s.OnLimitExceeded = func(local net.Addr) { exceeded <- local }
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	first := dial(t, addr)
+	echo(t, first, "hello")
+
+	second := dial(t, addr)
+	if !refused(second) {
+		t.Fatal("connection over the limit was forwarded")
+	}
+	select {
+	case local := <-exceeded:
+		if local.String() != second.LocalAddr().String() {
+			t.Fatalf("OnLimitExceeded got %s, want %s", local, second.LocalAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnLimitExceeded not called")
+	}
+	echo(t, first, "still open")
+	if n := s.RejectedConnections(); n != 1 {
+		t.Fatalf("%d rejected connections, want 1", n)
+	}
+}
+
+func TestLimitGracePeriod(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxConnections = 1
+	s.LimitGracePeriod = 5 * time.Second
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	first := dial(t, addr)
+	echo(t, first, "hello")
+	second := dial(t, addr)
+	second.Write([]byte("queued"))
+	time.Sleep(50 * time.Millisecond)
+	first.Close()
+
+	buf := make([]byte, len("queued"))
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "queued" {
+		t.Fatalf("queued connection not forwarded once a slot freed: %q, %v", buf, err)
+	}
+}
+
+func TestSetMaxConnectionsLower(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxConnections = 3
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	first, second := dial(t, addr), dial(t, addr)
+	echo(t, first, "a")
+	echo(t, second, "b")
+
+	s.SetMaxConnections(1)
+	if !refused(dial(t, addr)) {
+		t.Fatal("new connection forwarded over the lowered limit")
+	}
+	echo(t, first, "a")
+	echo(t, second, "b")
+
+	first.Close()
+	second.Close()
+	eventually(t, "connections to end", func() bool { return s.DrainedConnections() == 0 })
+	echo(t, dial(t, addr), "c")
+}
+
+func TestDrain(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	listener, err := s.listenTunnel("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.serveTunnel(listener, srv.EchoAddr) }()
+
+	conn := dial(t, addr)
+	echo(t, conn, "before")
+	s.Drain()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("tunnel returned %v after Drain", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel still serving after Drain")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("new connection accepted after Drain")
+	}
+	if n := s.DrainedConnections(); n != 1 {
+		t.Fatalf("%d drained connections, want 1", n)
+	}
+
+	// the existing transfer completes
+	data := bytes.Repeat([]byte("drain"), 100000)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("transfer after Drain failed: %v", err)
+	}
+	conn.Close()
+	eventually(t, "connection to finish", func() bool { return s.DrainedConnections() == 0 })
+}
+
+func TestPause(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	open := dial(t, addr)
+	echo(t, open, "before")
+	s.Pause()
+	if !refused(dial(t, addr)) {
+		t.Fatal("new connection forwarded while paused")
+	}
+	echo(t, open, "kept while paused")
+	s.Resume()
+	echo(t, dial(t, addr), "after")
+}
+
+func TestMaxConnections(t *testing.T) {
+	for _, max := range []int{Unlimited, -5, 0, 2} {
+		srv := newTestServer(t)
+		s := connectTestConn(t, srv)
+		s.MaxConnections = max
+		addr := startTestTunnel(t, s, srv.EchoAddr)
+
+		// a negative limit means none
+		n := max
+		if n < 0 {
+			n = 20
+		}
+		for i := 0; i < n; i++ {
+			echo(t, dial(t, addr), "within the limit")
+		}
+		if max >= 0 && !refused(dial(t, addr)) {
+			t.Fatalf("connection over MaxConnections %d forwarded", max)
+		}
+	}
+}
+
+func TestMaxConnectionsDefault(t *testing.T) {
+	srv := newTestServer(t)
+	if s := newTestConn(t, srv); s.MaxConnections != Unlimited {
+		t.Fatalf("MaxConnections %d by default, want Unlimited", s.MaxConnections)
+	}
+	s := connectTestConn(t, srv)
+	s.SetMaxConnections(0)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	if !refused(dial(t, addr)) {
+		t.Fatal("connection forwarded with MaxConnections 0")
+	}
+	s.SetMaxConnections(Unlimited)
+	echo(t, dial(t, addr), "limit lifted")
+}
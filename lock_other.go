@@ -0,0 +1,16 @@
+//go:build !unix || solaris || aix
+
+package sshts
+
+import "os"
+
+// flock is not available everywhere, platforms without it rely on the
+// in-process mutex and append mode.
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// checkForwardLoop returns an error if target is one of the local
+// listeners of s as seen from an ssh server running on this host, which
+// would make every forwarded connection open another one until the limits
+// are exhausted.
+//
+// Only a target naming a listener of s itself is detected, and only when
+// the ssh server runs on this host. A loop through another SSHConn, an
+// outside socks proxy or a remote host goes unnoticed, a plain tcp
+// connection has no room to carry a hop count.
+func (s *SSHConn) checkForwardLoop(target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	var matches []*net.TCPAddr
+	for l := range s.listeners {
+		if a, ok := l.Addr().(*net.TCPAddr); ok && a.Port == port {
+			matches = append(matches, a)
+		}
+	}
+	serverAddr := s.serverAddr
+	s.mu.Unlock()
+	if len(matches) == 0 {
+		return nil
+	}
+	serverHost, _, err := net.SplitHostPort(serverAddr)
+	if err != nil || !isLocalHost(serverHost) {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	loopback := host == "localhost" || host == "" || ip != nil && ip.IsLoopback()
+	for _, a := range matches {
+		if a.IP.IsUnspecified() && (host == "" || isLocalHost(host)) ||
+			loopback && a.IP.IsLoopback() || ip != nil && ip.Equal(a.IP) {
+			return fmt.Errorf("forwarding loop: %s is served by this tunnel", target)
+		}
+	}
+	return nil
+}
+
+// isLocalHost reports whether host names this machine.
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
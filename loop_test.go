@@ -0,0 +1,44 @@
+package sshts
+
+import (
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestForwardLoopRejected(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	listener, err := s.listenTunnel("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	go s.serveTunnel(listener, addr)
+
+	if !refused(dial(t, addr)) {
+		t.Fatal("connection forwarded to the tunnel itself")
+	}
+	eventually(t, "connection to be rejected", func() bool { return s.StatsSnapshot().Rejected == 1 })
+	if n := srv.MaxConcurrentOpens(); n != 0 {
+		t.Fatalf("%d channels opened for a loop", n)
+	}
+}
+
+func TestSocksLoopRejected(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, s.StartSocks5Server)
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialer.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("socks5 connection to the proxy itself was granted")
+	}
+	if n := srv.MaxConcurrentOpens(); n != 0 {
+		t.Fatalf("%d channels opened for a loop", n)
+	}
+}
@@ -0,0 +1,149 @@
+package sshts
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// stats are the counters kept for forwarded connections. bytesIn is data
+// received through ssh, bytesOut data sent into it.
+type stats struct {
+	active     atomic.Int64
+	total      atomic.Int64
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	dialErrors atomic.Int64
+	reconnects atomic.Int64
+	rejected   atomic.Int64
+	lastErr    atomic.Pointer[error]
+
+	// snapshotMu keeps StatsSnapshot from seeing a ResetStats half done.
+	snapshotMu sync.Mutex
+}
+
+// byteCounters count the data of a single connection.
+type byteCounters struct {
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// countingWriter adds the bytes written to the connection wide counter n
+// and the per connection counter conn, then calls written if set.
+type countingWriter struct {
+	w       io.Writer
+	n       *atomic.Int64
+	conn    *atomic.Int64
+	written func()
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	c.conn.Add(int64(n))
+	if c.written != nil {
+		c.written()
+	}
+	return n, err
+}
+
+// Stats is a copy of the connection counters. Active is a gauge, the
+// other counters are cumulative since start or the last ResetStats.
+type Stats struct {
+	Active     int64
+	Total      int64
+	BytesIn    int64
+	BytesOut   int64
+	DialErrors int64
+	Reconnects int64
+	Rejected   int64
+}
+
+// StatsSnapshot returns the current counters. It never sees a concurrent
+// ResetStats half done, so the counters are all from before or all from
+// after a reset.
+func (s *SSHConn) StatsSnapshot() Stats {
+	s.stats.snapshotMu.Lock()
+	defer s.stats.snapshotMu.Unlock()
+	return Stats{
+		Active:     s.stats.active.Load(),
+		Total:      s.stats.total.Load(),
+		BytesIn:    s.stats.bytesIn.Load(),
+		BytesOut:   s.stats.bytesOut.Load(),
+		DialErrors: s.stats.dialErrors.Load(),
+		Reconnects: s.stats.reconnects.Load(),
+		Rejected:   s.stats.rejected.Load(),
+	}
+}
+
+// ResetStats zeroes the cumulative counters, leaving Active alone, and
+// returns their values before the reset. Each counter is swapped
+// atomically, so reporting deltas from the result loses no counts.
+// MaxTotalBytes counts from the reset as well, but a quota already
+// reached stays reached.
+func (s *SSHConn) ResetStats() Stats {
+	s.stats.snapshotMu.Lock()
+	defer s.stats.snapshotMu.Unlock()
+	return Stats{
+		Active:     s.stats.active.Load(),
+		Total:      s.stats.total.Swap(0),
+		BytesIn:    s.stats.bytesIn.Swap(0),
+		BytesOut:   s.stats.bytesOut.Swap(0),
+		DialErrors: s.stats.dialErrors.Swap(0),
+		Reconnects: s.stats.reconnects.Swap(0),
+		Rejected:   s.stats.rejected.Swap(0),
+	}
+}
+
+// RejectedConnections is the number of connections refused by
+// MaxConnections, MaxSocksConnections, AllowedClientCIDRs, MaxTotalBytes or
+// loop detection.
+func (s *SSHConn) RejectedConnections() int64 {
+	return s.stats.rejected.Load()
+}
+
+// LastError returns the last error a forwarded connection failed or was
+// rejected with, or nil.
+func (s *SSHConn) LastError() error {
+	if err := s.stats.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (s *SSHConn) setLastError(err error) {
+	s.stats.lastErr.Store(&err)
+}
+
+// reject counts a refused connection and logs err as the reason.
+func (s *SSHConn) reject(err error) {
+	s.stats.rejected.Add(1)
+	s.setLastError(err)
+	s.logf("%s", err)
+}
+
+// MetricsHandler serves the connection counters in the Prometheus text
+// format, so they can be scraped without depending on the prometheus
+// client library.
+func (s *SSHConn) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics := []struct {
+			name, kind, help string
+			value            int64
+		}{
+			{"sshts_active_connections", "gauge", "Connections currently forwarded.", s.stats.active.Load()},
+			{"sshts_connections_total", "counter", "Connections forwarded since start.", s.stats.total.Load()},
+			{"sshts_received_bytes_total", "counter", "Bytes received through ssh.", s.stats.bytesIn.Load()},
+			{"sshts_sent_bytes_total", "counter", "Bytes sent through ssh.", s.stats.bytesOut.Load()},
+			{"sshts_dial_errors_total", "counter", "Failed dials to remote targets.", s.stats.dialErrors.Load()},
+			{"sshts_reconnects_total", "counter", "Successful reconnects of the ssh client.", s.stats.reconnects.Load()},
+			{"sshts_rejected_connections_total", "counter", "Connections refused by limits, allowed cidrs, quota or loop detection.", s.stats.rejected.Load()},
+		}
+		for _, m := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package sshts
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResetStats(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	closed := dial(t, addr)
+	echo(t, closed, "hello")
+	closed.Close()
+	echo(t, dial(t, addr), "still open")
+	eventually(t, "traffic to be counted", func() bool {
+		st := s.StatsSnapshot()
+		return st.Active == 1 && st.Total == 2 && st.BytesIn == 15 && st.BytesOut == 15
+	})
+
+	before := s.ResetStats()
+	if before.Total != 2 || before.BytesIn != 15 || before.BytesOut != 15 || before.Active != 1 {
+		t.Fatalf("ResetStats returned %+v", before)
+	}
+	if after := s.StatsSnapshot(); after != (Stats{Active: 1}) {
+		t.Fatalf("counters after ResetStats %+v, want only Active", after)
+	}
+}
+
+func TestStatsSnapshotDuringReset(t *testing.T) {
+	s := &SSHConn{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			// set the counters together, only ResetStats may split them
+			s.stats.snapshotMu.Lock()
+			s.stats.total.Store(7)
+			s.stats.bytesIn.Store(7)
+			s.stats.rejected.Store(7)
+			s.stats.snapshotMu.Unlock()
+			s.ResetStats()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			st := s.StatsSnapshot()
+			if st.BytesIn != st.Total || st.Rejected != st.Total {
+				t.Errorf("torn snapshot %+v", st)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "hello")
+	conn.Close()
+	eventually(t, "the connection to be counted", func() bool { return s.StatsSnapshot().Active == 0 })
+	if _, err := s.dialRemote("tcp", closedAddr(t)); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+
+	ts := httptest.NewServer(s.MetricsHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE sshts_active_connections gauge\nsshts_active_connections 0\n",
+		"# TYPE sshts_connections_total counter\nsshts_connections_total 1\n",
+		"sshts_received_bytes_total 5\n",
+		"sshts_sent_bytes_total 5\n",
+		"sshts_dial_errors_total 1\n",
+		"sshts_rejected_connections_total 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%q missing from\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package sshts
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Option configures Connect. Besides auth and host keys, options can set
+// the fields of the SSHConn used by tunnels, which may also be set
+// directly.
+type Option func(o *connectOptions)
+
+type connectOptions struct {
+	keyFiles   []string
+	password   string
+	agent      bool
+	knownHosts []string
+	insecure   bool
+	timeout    time.Duration
+	auth       []ssh.AuthMethod
+	hostKey    ssh.HostKeyCallback
+	// conn holds options setting fields of the SSHConn
+	conn []func(s *SSHConn)
+}
+
+// WithKeyFile authenticates with the private key in path. It may be given
+// more than once.
+func WithKeyFile(path string) Option {
+	return func(o *connectOptions) { o.keyFiles = append(o.keyFiles, path) }
+}
+
+// WithPassword authenticates with a password.
+func WithPassword(password string) Option {
+	return func(o *connectOptions) { o.password = password }
+}
+
+// WithAgent authenticates with the keys of the ssh agent at SSH_AUTH_SOCK.
+func WithAgent() Option {
+	return func(o *connectOptions) { o.agent = true }
+}
+
+// WithKnownHosts checks the server's host key against the known_hosts
+// files in paths.
+func WithKnownHosts(paths ...string) Option {
+	return func(o *connectOptions) { o.knownHosts = append(o.knownHosts, paths...) }
+}
+
+// WithInsecureHostKey accepts any host key, as New does.
+func WithInsecureHostKey() Option {
+	return func(o *connectOptions) { o.insecure = true }
+}
+
+// WithTimeout limits the time to establish the connection.
+func WithTimeout(d time.Duration) Option {
+	return func(o *connectOptions) { o.timeout = d }
+}
+
+// WithAuth authenticates with methods, e.g. keyboard-interactive, in
+// addition to the other auth options.
+func WithAuth(methods ...ssh.AuthMethod) Option {
+	return func(o *connectOptions) { o.auth = append(o.auth, methods...) }
+}
+
+// WithHostKeyCallback checks the server's host key with cb.
+func WithHostKeyCallback(cb ssh.HostKeyCallback) Option {
+	return func(o *connectOptions) { o.hostKey = cb }
+}
+
+// WithMaxConnections sets MaxConnections.
+func WithMaxConnections(n int) Option {
+	return withConn(func(s *SSHConn) { s.MaxConnections = n })
+}
+
+// WithBufferSize sets BufferSize.
+func WithBufferSize(size int) Option {
+	return withConn(func(s *SSHConn) { s.BufferSize = size })
+}
+
+// WithLogger sets Logger.
+func WithLogger(l *log.Logger) Option {
+	return withConn(func(s *SSHConn) { s.Logger = l })
+}
+
+// WithClientVersion sets ClientVersion.
+func WithClientVersion(version string) Option {
+	return withConn(func(s *SSHConn) { s.ClientVersion = version })
+}
+
+// WithDialTimeout sets DialTimeout.
+func WithDialTimeout(d time.Duration) Option {
+	return withConn(func(s *SSHConn) { s.DialTimeout = d })
+}
+
+func withConn(f func(s *SSHConn)) Option {
+	return func(o *connectOptions) { o.conn = append(o.conn, f) }
+}
+
+// Connect creates an SSHConn configured by opts and connects it.
+//
+// Without an auth option the ssh agent is used if SSH_AUTH_SOCK is set,
+// and ~/.ssh/id_ed25519, id_ecdsa and id_rsa if they exist. Without a host
+// key option ~/.ssh/known_hosts is used.
+func Connect(user, serverAddr string, opts ...Option) (*SSHConn, error) {
+	var o connectOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.keyFiles) == 0 && o.password == "" && !o.agent && len(o.auth) == 0 {
+		o.agent = os.Getenv("SSH_AUTH_SOCK") != ""
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				path := filepath.Join(home, ".ssh", name)
+				if _, err := os.Stat(path); err == nil {
+					o.keyFiles = append(o.keyFiles, path)
+				}
+			}
+		}
+	}
+	if len(o.knownHosts) == 0 && !o.insecure && o.hostKey == nil {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no known_hosts file given: %v", err)
+		}
+		o.knownHosts = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+
+	auth := o.auth
+	var agentKeys *agentSigners
+	if o.agent {
+		a, keys, err := agentAuth()
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, a)
+		agentKeys = keys
+	}
+	var signers []ssh.Signer
+	for _, path := range o.keyFiles {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private key %s: %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if o.password != "" {
+		auth = append(auth, ssh.Password(o.password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no auth method, no key file, password or ssh agent found")
+	}
+
+	hostKeyCallback := o.hostKey
+	if o.insecure {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else if hostKeyCallback == nil {
+		var err error
+		if hostKeyCallback, err = KnownHostsCallback(o.knownHosts...); err != nil {
+			return nil, fmt.Errorf("unable to read known_hosts: %v", err)
+		}
+	}
+
+	s := newSSHConn(user, serverAddr, auth, hostKeyCallback)
+	s.sshConf.Timeout = o.timeout
+	s.agentKeys = agentKeys
+	for _, f := range o.conn {
+		f(s)
+	}
+	if err := s.Connect(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,124 @@
+package sshts
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestConnectOptions(t *testing.T) {
+	srv := newTestServer(t)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, srv.ClientKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey)
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	s, err := Connect("test", srv.Addr,
+		WithKeyFile(keyFile),
+		WithKnownHosts(knownHostsFile),
+		WithTimeout(5*time.Second),
+		WithMaxConnections(3),
+		WithBufferSize(4096),
+		WithLogger(logger),
+		WithClientVersion("SSH-2.0-options"),
+		WithDialTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.MaxConnections != 3 || s.BufferSize != 4096 || s.Logger != logger || s.DialTimeout != time.Second {
+		t.Errorf("fields not set: MaxConnections %d, BufferSize %d, DialTimeout %v", s.MaxConnections, s.BufferSize, s.DialTimeout)
+	}
+	if got := srv.ClientVersions(); len(got) != 1 || got[0] != "SSH-2.0-options" {
+		t.Errorf("server saw client version %q, want SSH-2.0-options", got)
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "configured by options")
+}
+
+func TestConnectOptionsAuthAndHostKey(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := Connect("test", srv.Addr, WithAuth(ssh.PublicKeys(srv.ClientSigner)), WithInsecureHostKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// a known_hosts file without the server's key rejects it
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := Connect("test", srv.Addr, WithAuth(ssh.PublicKeys(srv.ClientSigner)), WithKnownHosts(empty)); err == nil {
+		s.Close()
+		t.Fatal("connected to a server missing from known_hosts")
+	}
+
+	if s, err := Connect("test", srv.Addr, WithKeyFile(filepath.Join(t.TempDir(), "missing")), WithInsecureHostKey()); err == nil {
+		s.Close()
+		t.Fatal("connected with a missing key file")
+	}
+}
+
+func TestConnectOptionsNoAuth(t *testing.T) {
+	srv := newTestServer(t)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err := Connect("test", srv.Addr, WithInsecureHostKey())
+	if err == nil || !strings.Contains(err.Error(), "no auth method") {
+		t.Fatalf("got %v, want a no auth method error", err)
+	}
+}
+
+func TestConnectTunnelOptions(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := Connect("test", srv.Addr,
+		WithAuth(ssh.PublicKeys(srv.ClientSigner)),
+		WithHostKeyCallback(ssh.FixedHostKey(srv.HostKey)),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithMaxConnections(1),
+		WithDialTimeout(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	first := dial(t, addr)
+	echo(t, first, "within the limit")
+	if !refused(dial(t, addr)) {
+		t.Fatal("connection over WithMaxConnections was forwarded")
+	}
+	first.Close()
+
+	srv.HoldChannels()
+	defer srv.ReleaseChannels()
+	eventually(t, "the slot to be released", func() bool { return s.StatsSnapshot().Active == 0 })
+	if !refused(dial(t, addr)) {
+		t.Fatal("dial held by the server did not time out")
+	}
+
+	if s, err := Connect("test", srv.Addr,
+		WithAuth(ssh.PublicKeys(srv.ClientSigner)),
+		WithHostKeyCallback(ssh.FixedHostKey(newTestKey(t).PublicKey())),
+	); err == nil {
+		s.Close()
+		t.Fatal("connected although WithHostKeyCallback rejects the key")
+	}
+}
@@ -0,0 +1,216 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrPoolExhausted = errors.New("ssh pool: max open connections reached")
+
+// SSHPool keeps authenticated connections to the same server so the ssh
+// handshake is paid once and reused across short-lived tunnels.
+type SSHPool struct {
+	factory func() (*SSHConn, error)
+	maxIdle int
+	maxOpen int
+
+	mu     sync.Mutex
+	idle   []*SSHConn
+	open   int
+	closed bool
+}
+
+// NewSSHPool creates a pool. factory must return a connected *SSHConn.
+// maxOpen <= 0 means no limit on open connections.
+func NewSSHPool(factory func() (*SSHConn, error), maxIdle, maxOpen int) *SSHPool {
+	return &SSHPool{
+		factory: factory,
+		maxIdle: maxIdle,
+		maxOpen: maxOpen,
+	}
+}
+
+// Get returns an idle connection that passed a keepalive check, or a new one
+// from the factory. Dead idle connections are discarded.
+func (p *SSHPool) Get() (*SSHConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("ssh pool is closed")
+	}
+	for len(p.idle) > 0 {
+		s := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if s.alive() {
+			return s, nil
+		}
+		s.Close()
+		p.mu.Lock()
+		p.open--
+	}
+	if p.maxOpen > 0 && p.open >= p.maxOpen {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	p.open++
+	p.mu.Unlock()
+
+	s, err := p.factory()
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put returns a connection to the pool. It is closed instead if the pool
+// already holds maxIdle connections, is closed, or the connection is dead.
+func (p *SSHPool) Put(s *SSHConn) {
+	if s == nil {
+		return
+	}
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.maxIdle && s.GetStatus() != StatusDisconnected {
+		p.idle = append(p.idle, s)
+		p.mu.Unlock()
+		return
+	}
+	p.open--
+	p.mu.Unlock()
+	s.Close()
+}
+
+// Close closes all idle connections. Connections still checked out are
+// closed when they are Put back.
+func (p *SSHPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.closed = true
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, s := range idle {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PoolDialer spreads dials over several connections of an SSHPool, to get
+// past the window and channel limits of a single ssh connection.
+type PoolDialer struct {
+	pool *SSHPool
+	size int
+
+	mu    sync.Mutex
+	conns []*SSHConn
+	next  int
+}
+
+// Dialer returns a dialer that takes up to size connections from the pool
+// and dials through them round-robin, replacing connections that were
+// lost. Close returns the connections to the pool.
+//
+//	transport := &http.Transport{DialContext: pool.Dialer(4).DialContext}
+func (p *SSHPool) Dialer(size int) *PoolDialer {
+	if size < 1 {
+		size = 1
+	}
+	return &PoolDialer{pool: p, size: size}
+}
+
+func (d *PoolDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, err := d.pick()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.DialTargetContext(ctx, network, addr)
+	if errors.Is(err, ErrConnectionLost) || errors.Is(err, ErrNotConnected) {
+		d.drop(s)
+	}
+	return conn, err
+}
+
+// pick returns the next connection in turn, taking a new one from the pool
+// while there are fewer than size.
+func (d *PoolDialer) pick() (*SSHConn, error) {
+	d.mu.Lock()
+	var dead []*SSHConn
+	live := d.conns[:0]
+	for _, s := range d.conns {
+		if s.GetStatus() == StatusDisconnected {
+			dead = append(dead, s)
+			continue
+		}
+		live = append(live, s)
+	}
+	d.conns = live
+	grow := len(d.conns) < d.size
+	d.mu.Unlock()
+	// Put may close the connection, keep it out of the lock
+	for _, s := range dead {
+		d.pool.Put(s)
+	}
+
+	var fresh *SSHConn
+	var err error
+	if grow {
+		fresh, err = d.pool.Get()
+	}
+	d.mu.Lock()
+	if fresh != nil {
+		// other dials may have filled the dialer while the lock was dropped
+		if len(d.conns) < d.size {
+			d.conns = append(d.conns, fresh)
+			fresh = nil
+		}
+	}
+	if len(d.conns) == 0 {
+		d.mu.Unlock()
+		if err == nil {
+			err = ErrNotConnected
+		}
+		return nil, err
+	}
+	s := d.conns[d.next%len(d.conns)]
+	d.next++
+	d.mu.Unlock()
+	if fresh != nil {
+		d.pool.Put(fresh)
+	}
+	return s, nil
+}
+
+func (d *PoolDialer) drop(s *SSHConn) {
+	d.mu.Lock()
+	for i, c := range d.conns {
+		if c == s {
+			d.conns = append(d.conns[:i], d.conns[i+1:]...)
+			d.mu.Unlock()
+			d.pool.Put(s)
+			return
+		}
+	}
+	d.mu.Unlock()
+}
+
+// Close returns the connections of the dialer to the pool.
+func (d *PoolDialer) Close() error {
+	d.mu.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.mu.Unlock()
+	for _, s := range conns {
+		d.pool.Put(s)
+	}
+	return nil
+}
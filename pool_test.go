@@ -0,0 +1,137 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/kslamph/sshts/testutil"
+)
+
+func newTestPool(t *testing.T, maxIdle, maxOpen int) (*SSHPool, *int) {
+	srv := newTestServer(t)
+	created := 0
+	var mu sync.Mutex
+	pool := NewSSHPool(func() (*SSHConn, error) {
+		mu.Lock()
+		created++
+		mu.Unlock()
+		return connectTestConn(t, srv), nil
+	}, maxIdle, maxOpen)
+	t.Cleanup(func() { pool.Close() })
+	return pool, &created
+}
+
+func TestPoolReuse(t *testing.T) {
+	pool, created := newTestPool(t, 1, 0)
+	s1, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(s1)
+	s2, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2 != s1 || *created != 1 {
+		t.Fatalf("idle connection not reused, %d created", *created)
+	}
+}
+
+func TestPoolEvictsDead(t *testing.T) {
+	pool, created := newTestPool(t, 1, 1)
+	s1, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(s1)
+	s1.Client().Close()
+
+	s2, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2 == s1 || *created != 2 {
+		t.Fatalf("dead connection returned, %d created", *created)
+	}
+	if !s2.alive() {
+		t.Fatal("new connection is not alive")
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	pool, _ := newTestPool(t, 1, 1)
+	s1, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get(); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("got %v, want ErrPoolExhausted", err)
+	}
+	pool.Put(s1)
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolDialerSpreadsDials(t *testing.T) {
+	// every connection goes to its own server, so the targets each one
+	// saw tell where the dials went
+	var mu sync.Mutex
+	var servers []*testutil.Server
+	echoSrv := newTestServer(t)
+	pool := NewSSHPool(func() (*SSHConn, error) {
+		srv := newTestServer(t)
+		mu.Lock()
+		servers = append(servers, srv)
+		mu.Unlock()
+		return connectTestConn(t, srv), nil
+	}, 4, 0)
+	t.Cleanup(func() { pool.Close() })
+	d := pool.Dialer(2)
+	defer d.Close()
+
+	for i := 0; i < 4; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", echoSrv.EchoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "spread")
+		conn.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	used := 0
+	for _, srv := range servers {
+		if len(srv.Targets()) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("dials went through %d of %d connections, want at least 2", used, len(servers))
+	}
+}
+
+func TestPoolDialerConcurrentPick(t *testing.T) {
+	pool, _ := newTestPool(t, 8, 0)
+	d := pool.Dialer(2)
+	defer d.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.pick(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.conns) > 2 {
+		t.Fatalf("dialer holds %d connections, want at most 2", len(d.conns))
+	}
+}
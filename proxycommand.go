@@ -0,0 +1,72 @@
+package sshts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// dialProxyCommand starts command with %h, %p and %r replaced by the
+// server host, port and user, and returns a conn over its stdin and stdout,
+// like ssh's ProxyCommand.
+func dialProxyCommand(command, serverAddr, user string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	command = strings.NewReplacer("%h", host, "%p", port, "%r", user, "%%", "%").Replace(command)
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start proxy command: %v", err)
+	}
+	return &cmdConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: serverAddr}, nil
+}
+
+// cmdConn is a net.Conn over a process' stdin and stdout.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   string
+}
+
+func (c *cmdConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *cmdConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *cmdConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr  { return cmdAddr("proxy-command") }
+func (c *cmdConn) RemoteAddr() net.Addr { return cmdAddr(c.addr) }
+
+// deadlines are not supported on pipes to a process
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type cmdAddr string
+
+func (a cmdAddr) Network() string { return "proxy-command" }
+func (a cmdAddr) String() string  { return string(a) }
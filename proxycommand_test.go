@@ -0,0 +1,58 @@
+package sshts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestProxyCommandHelper is the proxy command started by TestProxyCommand,
+// it connects stdin and stdout to the host and port it is given, like
+// nc %h %p.
+func TestProxyCommandHelper(t *testing.T) {
+	if os.Getenv("SSHTS_PROXY_COMMAND_HELPER") != "1" {
+		t.Skip("run by TestProxyCommand")
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 4 || args[3] != "test" {
+		fmt.Fprintf(os.Stderr, "want -- host port user, got %q\n", args)
+		os.Exit(2)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[1], args[2]))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestProxyCommand(t *testing.T) {
+	srv := newTestServer(t)
+	t.Setenv("SSHTS_PROXY_COMMAND_HELPER", "1")
+
+	s := newTestConn(t, srv)
+	s.ProxyCommand = fmt.Sprintf("%s -test.run=^TestProxyCommandHelper$ -- %%h %%p %%r", os.Args[0])
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if addr := s.Client().RemoteAddr(); addr.Network() != "proxy-command" || addr.String() != srv.Addr {
+		t.Errorf("connected over %s %s, want the proxy command", addr.Network(), addr)
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "through the proxy command")
+}
+
+func TestProxyCommandFails(t *testing.T) {
+	s := newTestConn(t, newTestServer(t))
+	s.ProxyCommand = "exit 1"
+	if err := s.Connect(); err == nil {
+		t.Fatal("connected through a proxy command that exited")
+	}
+}
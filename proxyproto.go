@@ -0,0 +1,155 @@
+package sshts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes a PROXY protocol header of the given version (1 or
+// 2) telling the receiver that the connection came from src to dst.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(src, dst)
+	case 2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return fmt.Errorf("unsupported proxy protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		// LOCAL command, the receiver uses the real connection endpoints
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var addrs []byte
+	family := byte(0x21) // TCP over IPv6
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		family = 0x11 // TCP over IPv4
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+	buf.WriteByte(0x21) // version 2, PROXY command
+	buf.WriteByte(family)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+// readProxyHeader reads a PROXY protocol header of either version from r
+// and returns the source and destination it announces. Both are nil for
+// the LOCAL command and UNKNOWN family.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		// a v1 header is at most 107 bytes long
+		if len(line) >= 107 {
+			return nil, nil, fmt.Errorf("proxy protocol header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+		}
+		line = append(line, c)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, serr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, derr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || serr != nil || derr != nil {
+		return nil, nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("failed to read proxy protocol header: %v", err)
+	}
+	if head[12]&0x0f == 0 {
+		return nil, nil, nil // LOCAL
+	}
+
+	var ipLen int
+	switch head[13] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil // not TCP, addresses are not reported
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("proxy protocol header too short")
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,124 @@
+package sshts
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteProxyHeaderIPv4(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 51000}
+	dst := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+
+	var v1 bytes.Buffer
+	if err := writeProxyHeader(&v1, 1, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 192.0.2.10 127.0.0.1 51000 8080\r\n"; v1.String() != want {
+		t.Fatalf("v1 header %q, want %q", v1.String(), want)
+	}
+
+	var v2 bytes.Buffer
+	if err := writeProxyHeader(&v2, 2, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, proxyV2Signature...),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 0, 2, 10,
+		127, 0, 0, 1,
+		0xc7, 0x38,
+		0x1f, 0x90,
+	)
+	if !bytes.Equal(v2.Bytes(), want) {
+		t.Fatalf("v2 header %x, want %x", v2.Bytes(), want)
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.SendProxyProtocol = 1
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		headers <- line
+	}()
+	addr := startTestTunnel(t, s, backend.Addr().String())
+
+	conn := dial(t, addr)
+	client := conn.LocalAddr().(*net.TCPAddr)
+	local := conn.RemoteAddr().(*net.TCPAddr)
+	want := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", client.IP, local.IP, client.Port, local.Port)
+	select {
+	case got := <-headers:
+		if got != want {
+			t.Fatalf("backend got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no header received")
+	}
+}
+
+func TestAcceptProxyProtocolV2(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.AcceptProxyProtocol = true
+	headers := make(chan net.Addr, 1)
+	s.OnProxyHeader = func(client, dst net.Addr) { headers <- client }
+	remote, err := s.StartReverseTunnel("127.0.0.1:0", srv.EchoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, remote.String())
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	if err := writeProxyHeader(conn, 2, client, remote); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-headers:
+		if got.String() != client.String() {
+			t.Fatalf("client address %v, want %v", got, client)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnProxyHeader not called")
+	}
+	echo(t, conn, "header stripped")
+}
+
+func TestAcceptProxyProtocolTimeout(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	s.AcceptProxyProtocol = true
+	remote, err := s.StartReverseTunnel("127.0.0.1:0", srv.EchoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, remote.String())
+	conn.Write([]byte("PROXY TCP4 "))
+	clk.waitTimers(t, 1)
+	clk.Advance(proxyHeaderTimeout)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection open after the header timeout")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection not closed after the header timeout")
+	}
+}
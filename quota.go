@@ -0,0 +1,39 @@
+package sshts
+
+// quotaExceeded reports whether the forwarded connections together have
+// transferred MaxTotalBytes, now or before the counters were reset.
+func (s *SSHConn) quotaExceeded() bool {
+	if s.MaxTotalBytes <= 0 {
+		return false
+	}
+	return s.quotaReached.Load() || s.stats.bytesIn.Load()+s.stats.bytesOut.Load() >= s.MaxTotalBytes
+}
+
+// checkQuota acts once when MaxTotalBytes is reached: it logs, closes the
+// listeners, and the forwarded connections if CloseOnQuota is set, and
+// calls OnQuotaExceeded. untrackConn closes the SSHConn once the last
+// connection is gone.
+func (s *SSHConn) checkQuota() {
+	if !s.quotaExceeded() || !s.quotaReached.CompareAndSwap(false, true) {
+		return
+	}
+	s.mu.Lock()
+	if s.reason == nil {
+		s.reason = ErrQuotaExceeded
+	}
+	s.draining = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	if s.CloseOnQuota {
+		for c := range s.conns {
+			c.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.logf("quota of %d bytes reached, closing listeners", s.MaxTotalBytes)
+	if s.OnQuotaExceeded != nil {
+		s.OnQuotaExceeded()
+	}
+}
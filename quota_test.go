@@ -0,0 +1,83 @@
+package sshts
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitDone fails unless s is done within a few seconds.
+func waitDone(t *testing.T, s *SSHConn) {
+	t.Helper()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed")
+	}
+}
+
+func TestQuotaShutsTunnel(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxTotalBytes = 100
+	s.CloseOnQuota = true
+	exceeded := make(chan struct{}, 2)
+	s.OnQuotaExceeded = func() { exceeded <- struct{}{} }
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "under quota")
+	conn.Write([]byte(strings.Repeat("x", 100)))
+	select {
+	case <-exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnQuotaExceeded not called")
+	}
+	if !refused(conn) {
+		t.Fatal("connection still open with CloseOnQuota")
+	}
+	waitDone(t, s)
+	if err := s.Reason(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Reason %v, want ErrQuotaExceeded", err)
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("tunnel still listening after the quota was reached")
+	}
+
+	// the quota is one-shot
+	s.ResetStats()
+	if !s.quotaExceeded() {
+		t.Fatal("ResetStats lifted the quota")
+	}
+	if len(exceeded) != 0 {
+		t.Fatal("OnQuotaExceeded called twice")
+	}
+}
+
+func TestQuotaLetsConnectionsFinish(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxTotalBytes = 10
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "over the quota")
+	eventually(t, "listener to close", func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+	echo(t, conn, "still forwarded")
+	select {
+	case <-s.Done():
+		t.Fatal("Done closed while a connection is left")
+	default:
+	}
+	conn.Close()
+	waitDone(t, s)
+}
@@ -0,0 +1,6 @@
+//go:build 386 || amd64 || arm
+
+package sshts
+
+// SO_REUSEPORT, which package syscall does not define for these ports.
+const soReusePort = 0xf
@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package sshts
+
+import "testing"
+
+func TestReusePort(t *testing.T) {
+	srv := newTestServer(t)
+	first := connectTestConn(t, srv)
+	second := connectTestConn(t, srv)
+	first.ReusePort = true
+	second.ReusePort = true
+
+	l1, err := first.listenTunnel("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l1.Addr().String()
+	l2, err := second.listenTunnel(addr)
+	if err != nil {
+		t.Fatalf("second listener on %s: %v", addr, err)
+	}
+	go first.serveTunnel(l1, srv.EchoAddr)
+	go second.serveTunnel(l2, srv.EchoAddr)
+	echo(t, dial(t, addr), "either listener")
+
+	// the old listener drains, the new one keeps the port
+	l1.Close()
+	echo(t, dial(t, addr), "after the first closed")
+
+	other := connectTestConn(t, srv)
+	if l, err := other.listenTunnel(addr); err == nil {
+		l.Close()
+		t.Fatal("listened on a taken port without ReusePort")
+	}
+}
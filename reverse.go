@@ -0,0 +1,122 @@
+package sshts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// StartReverseTunnel asks the ssh server to listen on remote and forwards
+// every connection it accepts to local. It returns once the remote listener
+// is up, with the address the server actually bound, so a remote port of 0
+// reports the port the server allocated. The tunnel runs until the SSHConn
+// is closed.
+func (s *SSHConn) StartReverseTunnel(remote, local string) (net.Addr, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on remote %s: %v", remote, err)
+	}
+	if !s.trackListener(listener) {
+		return nil, fmt.Errorf("ssh client is closing")
+	}
+
+	s.serveReverse(listener, "tcp", local)
+	return listener.Addr(), nil
+}
+
+// StartReverseUnixTunnel makes the ssh server listen on the unix socket
+// remoteSocketPath and forwards connections to it to the local unix socket
+// localSocketPath, e.g. to give a remote process access to a local docker
+// socket. The server must allow streamlocal forwarding (OpenSSH
+// AllowStreamLocalForwarding) and does not remove an existing socket file
+// unless StreamLocalBindUnlink is set. Like StartReverseTunnel it does not
+// block; unix sockets are not available locally on older Windows versions.
+func (s *SSHConn) StartReverseUnixTunnel(remoteSocketPath, localSocketPath string) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	listener, err := client.ListenUnix(remoteSocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on remote socket %s: %v", remoteSocketPath, err)
+	}
+	if !s.trackListener(listener) {
+		return fmt.Errorf("ssh client is closing")
+	}
+	s.serveReverse(listener, "unix", localSocketPath)
+	return nil
+}
+
+// serveReverse forwards connections accepted on the remote listener to
+// local in the background until the listener is closed.
+func (s *SSHConn) serveReverse(listener net.Listener, network, local string) {
+	started := s.spawn(func() {
+		defer s.untrackListener(listener)
+		defer listener.Close()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if !s.spawn(func() { s.reverseForward(conn, network, local) }) {
+				conn.Close()
+				return
+			}
+		}
+	})
+	if !started {
+		s.untrackListener(listener)
+		listener.Close()
+	}
+}
+
+// proxyHeaderTimeout bounds reading the PROXY header of a reverse tunnel
+// connection.
+const proxyHeaderTimeout = 10 * time.Second
+
+func (s *SSHConn) reverseForward(remoteConn net.Conn, network, local string) {
+	if !s.trackConn(remoteConn) {
+		return
+	}
+	defer s.untrackConn(remoteConn)
+	defer remoteConn.Close()
+
+	var remote io.ReadWriteCloser = remoteConn
+	if s.AcceptProxyProtocol {
+		// ssh channels have no read deadlines, give up by closing
+		timer := s.clk().AfterFunc(proxyHeaderTimeout, func() { remoteConn.Close() })
+		pc := &peekedConn{Conn: remoteConn, r: bufio.NewReader(remoteConn)}
+		src, dst, err := readProxyHeader(pc.r)
+		if !timer.Stop() && err == nil {
+			err = fmt.Errorf("proxy protocol header not read within %s", proxyHeaderTimeout)
+		}
+		if err != nil {
+			s.logf("reverse tunnel to %s: %s", local, err)
+			return
+		}
+		if s.OnProxyHeader != nil && src != nil {
+			s.OnProxyHeader(src, dst)
+		}
+		remote = pc
+	}
+
+	localConn, err := net.Dial(network, local)
+	if err != nil {
+		s.logf("local dial error: %s", err)
+		return
+	}
+	if !s.trackConn(localConn) {
+		return
+	}
+	defer s.untrackConn(localConn)
+	defer localConn.Close()
+
+	s.pipe(localConn, remote, nil)
+}
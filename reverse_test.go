@@ -0,0 +1,66 @@
+package sshts
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestReverseTunnelAssignedPort(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr, err := s.StartReverseTunnel("127.0.0.1:0", srv.EchoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := addr.(*net.TCPAddr).Port; port == 0 {
+		t.Fatalf("reported %v, want the port the server assigned", addr)
+	}
+	echo(t, dial(t, addr.String()), "reverse")
+}
+
+func TestReverseUnixTunnel(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	dir := t.TempDir()
+
+	local := filepath.Join(dir, "local.sock")
+	l, err := net.Listen("unix", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	remote := filepath.Join(dir, "remote.sock")
+	if err := s.StartReverseUnixTunnel(remote, local); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "over unix sockets")
+
+	s.Close()
+	eventually(t, "the remote socket to stop listening", func() bool {
+		conn, err := net.Dial("unix", remote)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+}
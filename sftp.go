@@ -0,0 +1,100 @@
+//go:build !js && !wasip1
+
+package sshts
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// UploadFile copies localPath to remotePath over sftp, creating missing
+// remote directories and keeping the file permissions. It is not built for
+// js and wasip1, which pkg/sftp does not support.
+func (s *SSHConn) UploadFile(localPath, remotePath string) error {
+	client, err := s.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %v", err)
+	}
+
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return fmt.Errorf("failed to create remote directory: %v", err)
+	}
+	dst, err := client.Create(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to create remote file: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", localPath, err)
+	}
+	if err := dst.Chmod(info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set remote file mode: %v", err)
+	}
+	return dst.Close()
+}
+
+// DownloadFile copies remotePath to localPath over sftp, creating missing
+// local directories and keeping the file permissions.
+func (s *SSHConn) DownloadFile(remotePath, localPath string) error {
+	client, err := s.sftpClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	src, err := client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %v", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat remote file: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %v", err)
+	}
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to download %s: %v", remotePath, err)
+	}
+	if err := dst.Chmod(info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set local file mode: %v", err)
+	}
+	return dst.Close()
+}
+
+func (s *SSHConn) sftpClient() (*sftp.Client, error) {
+	sshClient, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sftp session: %v", err)
+	}
+	return client, nil
+}
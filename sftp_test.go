@@ -0,0 +1,59 @@
+//go:build !js && !wasip1
+
+package sshts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadDownloadFile(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+	dir := t.TempDir()
+
+	local := filepath.Join(dir, "local.txt")
+	if err := os.WriteFile(local, []byte("payload"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// the test server serves this filesystem, remote paths are local too
+	remote := filepath.Join(dir, "remote", "sub", "file.txt")
+	if err := s.UploadFile(local, remote); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(remote)
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("uploaded %q, %v", data, err)
+	}
+	if info, err := os.Stat(remote); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("uploaded mode %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+
+	if err := os.Chmod(remote, 0600); err != nil {
+		t.Fatal(err)
+	}
+	back := filepath.Join(dir, "down", "back.txt")
+	if err := s.DownloadFile(remote, back); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(back)
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("downloaded %q, %v", data, err)
+	}
+	if info, err := os.Stat(back); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("downloaded mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestDownloadFileMissing(t *testing.T) {
+	s := connectTestConn(t, newTestServer(t))
+	dir := t.TempDir()
+	err := s.DownloadFile(filepath.Join(dir, "missing"), filepath.Join(dir, "out"))
+	if err == nil {
+		t.Fatal("downloading a missing file succeeded")
+	}
+	if _, statErr := os.Stat(filepath.Join(dir, "out")); !errors.Is(statErr, os.ErrNotExist) {
+		t.Fatalf("local file created for a failed download: %v", statErr)
+	}
+}
@@ -0,0 +1,278 @@
+package sshts
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SocksVersions selects the protocols served by StartSocksServer.
+type SocksVersions int
+
+const (
+	Socks4 SocksVersions = 1 << iota
+	// Socks4a is Socks4 with host names, resolved on the ssh server side
+	// unless ResolveRemoteLocally is set.
+	Socks4a
+	Socks5
+)
+
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// StartSocksServer is like StartSocks5Server but serves the given socks
+// versions on the same listener, telling them apart by the first byte a
+// client sends. It blocks until the listener fails or the SSHConn is
+// closed.
+//
+// The BIND command of socks4 and socks5 is served by listening on the ssh
+// server, on IPv6 for socks5 requests with an IPv6 address.
+func (s *SSHConn) StartSocksServer(addr string, versions SocksVersions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, serverSocks, err := s.listenSocks5(ctx, addr)
+	if err == errClosing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer s.untrackListener(l)
+	defer l.Close()
+	s.status.CompareAndSwap(int64(StatusConnected), int64(StatusSocks5Running))
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.acceptStopped() {
+				return nil
+			}
+			return fmt.Errorf("socks server failed: %v", err)
+		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return nil
+		}
+		started := s.spawn(func() {
+			defer s.untrackConn(conn)
+			defer conn.Close()
+
+			pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+			version, err := pc.r.Peek(1)
+			if err != nil {
+				return
+			}
+			switch {
+			case version[0] == 5 && versions&Socks5 != 0:
+				err = s.serveSocks5Conn(pc, serverSocks)
+			case version[0] == 4 && versions&(Socks4|Socks4a) != 0:
+				err = s.serveSocks4(pc, versions&Socks4a != 0)
+			default:
+				err = fmt.Errorf("unsupported socks version %d from %s", version[0], conn.RemoteAddr())
+			}
+			if err != nil && !s.isClosing() {
+				s.logf("%s", err)
+			}
+		})
+		if !started {
+			s.untrackConn(conn)
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// serveSocks4 handles a socks4 CONNECT or BIND request.
+func (s *SSHConn) serveSocks4(conn *peekedConn, allowNames bool) error {
+	var req [8]byte
+	if _, err := io.ReadFull(conn.r, req[:]); err != nil {
+		return fmt.Errorf("failed to read socks4 request: %v", err)
+	}
+	if _, err := readNullTerminated(conn.r); err != nil { // user id
+		return err
+	}
+	port := binary.BigEndian.Uint16(req[2:4])
+	ip := net.IP(req[4:8])
+	host := ip.String()
+	// 0.0.0.x with x != 0 marks a socks4a request with a host name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readNullTerminated(conn.r)
+		if err != nil {
+			return err
+		}
+		if !allowNames {
+			writeSocks4Reply(conn, socks4Rejected, nil)
+			return fmt.Errorf("socks4a request for %s from %s refused, socks4a not enabled", name, conn.RemoteAddr())
+		}
+		host = name
+	}
+	switch req[1] {
+	case 1:
+	case 2:
+		if host != ip.String() {
+			// a socks4a name cannot be checked against the peer address
+			ip = net.IPv4zero
+		}
+		return s.serveSocks4Bind(conn, ip)
+	default:
+		writeSocks4Reply(conn, socks4Rejected, nil)
+		return fmt.Errorf("unsupported socks4 command %d from %s", req[1], conn.RemoteAddr())
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if err := s.acquireSocksSlot(addr); err != nil {
+		writeSocks4Reply(conn, socks4Rejected, nil)
+		return err
+	}
+	remote, err := s.dialRemote("tcp", addr)
+	if err != nil {
+		s.releaseSocksSlot()
+		writeSocks4Reply(conn, socks4Rejected, nil)
+		return err
+	}
+	if !s.trackConn(remote) {
+		s.releaseSocksSlot()
+		remote.Close()
+		return errClosing
+	}
+	defer s.untrackConn(remote)
+	defer remote.Close()
+	counted := s.countSocksConn(remote, addr)
+	defer counted.Close()
+	if s.LogConnections {
+		s.logf("socks4 %s -> %s", conn.RemoteAddr(), addr)
+	}
+	if err := writeSocks4Reply(conn, socks4Granted, nil); err != nil {
+		return err
+	}
+	s.pipe(conn, counted, nil)
+	return nil
+}
+
+// serveSocks4Bind handles a socks4 BIND request, relaying the first
+// connection to a port opened on the ssh server from peer, or from anywhere
+// if peer is 0.0.0.0.
+func (s *SSHConn) serveSocks4Bind(conn *peekedConn, peer net.IP) error {
+	listener, bound, err := s.listenBind(conn, false)
+	if err != nil {
+		writeSocks4Reply(conn, socks4Rejected, nil)
+		return err
+	}
+	defer s.untrackListener(listener)
+	defer listener.Close()
+	if err := writeSocks4Reply(conn, socks4Granted, bound); err != nil {
+		return err
+	}
+
+	remote, from, err := s.acceptBind(conn, listener, peer)
+	if err != nil {
+		writeSocks4Reply(conn, socks4Rejected, nil)
+		return err
+	}
+	defer s.untrackConn(remote)
+	defer remote.Close()
+	if err := writeSocks4Reply(conn, socks4Granted, from); err != nil {
+		return err
+	}
+	s.pipe(conn, remote, nil)
+	return nil
+}
+
+// listenBind opens a port on the ssh server for a socks BIND request, used
+// e.g. by active ftp, and returns the address to tell the client.
+func (s *SSHConn) listenBind(conn net.Conn, ipv6 bool) (net.Listener, *net.TCPAddr, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr := "0.0.0.0:0"
+	if ipv6 {
+		laddr = "[::]:0"
+	}
+	listener, err := client.Listen("tcp", laddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to bind on remote for %s: %v", conn.RemoteAddr(), err)
+	}
+	if !s.trackListener(listener) {
+		listener.Close()
+		return nil, nil, errClosing
+	}
+
+	bound, _ := listener.Addr().(*net.TCPAddr)
+	if bound != nil && bound.IP.IsUnspecified() {
+		// tell the client an address of the server it can pass on
+		if server, ok := client.RemoteAddr().(*net.TCPAddr); ok && (server.IP.To4() == nil) == ipv6 {
+			bound = &net.TCPAddr{IP: server.IP, Port: bound.Port}
+		}
+	}
+	return listener, bound, nil
+}
+
+// acceptBind waits for the first connection to a BIND listener and returns
+// it with its address if it comes from peer, or from anywhere if peer is
+// unspecified.
+func (s *SSHConn) acceptBind(conn net.Conn, listener net.Listener, peer net.IP) (net.Conn, *net.TCPAddr, error) {
+	remote, err := listener.Accept()
+	if err != nil {
+		return nil, nil, fmt.Errorf("bind for %s failed: %v", conn.RemoteAddr(), err)
+	}
+	listener.Close()
+	from, _ := remote.RemoteAddr().(*net.TCPAddr)
+	if !peer.IsUnspecified() && (from == nil || !from.IP.Equal(peer)) {
+		remote.Close()
+		return nil, nil, fmt.Errorf("bind for %s rejected connection from %v", conn.RemoteAddr(), remote.RemoteAddr())
+	}
+	if !s.trackConn(remote) {
+		remote.Close()
+		return nil, nil, errClosing
+	}
+	return remote, from, nil
+}
+
+// writeSocks4Reply sends code and, for BIND, the address in addr.
+func writeSocks4Reply(w io.Writer, code byte, addr *net.TCPAddr) error {
+	reply := []byte{0, code, 0, 0, 0, 0, 0, 0}
+	if addr != nil {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		}
+	}
+	_, err := w.Write(reply)
+	return err
+}
+
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var b []byte
+	for len(b) < 256 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("failed to read socks4 request: %v", err)
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		b = append(b, c)
+	}
+	return "", fmt.Errorf("socks4 request field too long")
+}
+
+// peekedConn is a conn whose first bytes were already read into r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
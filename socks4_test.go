@@ -0,0 +1,166 @@
+package sshts
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSocksTestServer runs start, e.g. s.StartSocks5Server, on a free
+// port and returns the address once it accepts connections.
+func startSocksTestServer(t *testing.T, start func(addr string) error) string {
+	t.Helper()
+	addr := closedAddr(t)
+	go start(addr)
+	eventually(t, "socks server to listen", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return addr
+}
+
+// socks4Connect sends a socks4 CONNECT for target, as socks4a when host is
+// a name, and returns the reply code.
+func socks4Connect(t *testing.T, conn net.Conn, target string) byte {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	req := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(port))
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, ip...), 0)
+	} else {
+		req = append(append(append(req, 0, 0, 0, 1, 0), host...), 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0
+	}
+	return reply[1]
+}
+
+func TestSocks4a(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, func(addr string) error {
+		return s.StartSocksServer(addr, Socks4|Socks4a|Socks5)
+	})
+	_, port, _ := net.SplitHostPort(srv.EchoAddr)
+
+	conn := dial(t, addr)
+	if code := socks4Connect(t, conn, net.JoinHostPort("localhost", port)); code != socks4Granted {
+		t.Fatalf("socks4a reply %#x", code)
+	}
+	echo(t, conn, "socks4a")
+
+	conn = dial(t, addr)
+	if code := socks4Connect(t, conn, srv.EchoAddr); code != socks4Granted {
+		t.Fatalf("socks4 reply %#x", code)
+	}
+	echo(t, conn, "socks4")
+}
+
+func TestSocks5OnSharedListener(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, func(addr string) error {
+		return s.StartSocksServer(addr, Socks4|Socks4a|Socks5)
+	})
+	echo(t, dialSocks5(t, addr, srv.EchoAddr), "socks5")
+}
+
+func TestSocks4aDisabled(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, func(addr string) error {
+		return s.StartSocksServer(addr, Socks4|Socks5)
+	})
+	_, port, _ := net.SplitHostPort(srv.EchoAddr)
+
+	if code := socks4Connect(t, dial(t, addr), net.JoinHostPort("localhost", port)); code != socks4Rejected {
+		t.Fatalf("socks4a request got reply %#x with socks4a disabled", code)
+	}
+}
+
+// readSocks5Reply reads a socks5 reply and returns its code and address.
+func readSocks5Reply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	ip := make(net.IP, net.IPv4len)
+	if head[3] == 4 {
+		ip = make(net.IP, net.IPv6len)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, ip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, port); err != nil {
+		t.Fatal(err)
+	}
+	return head[1], &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, func(addr string) error {
+		return s.StartSocksServer(addr, Socks5)
+	})
+
+	for _, peer := range []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback} {
+		t.Run(peer.String(), func(t *testing.T) {
+			if peer.To4() == nil {
+				l, err := net.Listen("tcp", "[::1]:0")
+				if err != nil {
+					t.Skip("no IPv6 loopback")
+				}
+				l.Close()
+			}
+			conn := dial(t, addr)
+			atyp := byte(1)
+			if peer.To4() == nil {
+				atyp = 4
+			}
+			req := append([]byte{5, 1, 0, 5, 2, 0, atyp}, peer...)
+			if _, err := conn.Write(append(req, 0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+				t.Fatalf("method reply %v, %v", method, err)
+			}
+			code, bound := readSocks5Reply(t, conn)
+			if code != socks5Granted {
+				t.Fatalf("bind reply %d", code)
+			}
+			if (bound.IP.To4() == nil) != (peer.To4() == nil) {
+				t.Fatalf("bound address %v for a request from %v", bound, peer)
+			}
+
+			// the mock remote connects back to the bound port
+			back := dial(t, net.JoinHostPort(peer.String(), strconv.Itoa(bound.Port)))
+			code, from := readSocks5Reply(t, conn)
+			if code != socks5Granted {
+				t.Fatalf("second bind reply %d", code)
+			}
+			if !from.IP.Equal(peer) || from.Port != back.LocalAddr().(*net.TCPAddr).Port {
+				t.Fatalf("peer reported as %v, connected from %v", from, back.LocalAddr())
+			}
+			go io.Copy(back, back)
+			echo(t, conn, "through bind")
+		})
+	}
+}
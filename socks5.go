@@ -1,38 +1,378 @@
 package sshts
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 
 	"github.com/armon/go-socks5"
 )
 
 func (s *SSHConn) StartSocks5Server(socks5Address string) error {
-	if s.sshClient == nil || s.status == 0 {
-		return fmt.Errorf("ssh client is not connected")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, serverSocks, err := s.listenSocks5(ctx, socks5Address)
+	if err == errClosing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.serveSocks5(l, serverSocks)
+}
+
+// StartSocks5ServerContext is like StartSocks5Server but also stops when
+// ctx is done, closing the listener and the connections it accepted. The
+// status returns to StatusConnected then. Close remains the single way to
+// tear down the SSHConn, cancelling ctx only stops this server, and the
+// two may be done in either order.
+func (s *SSHConn) StartSocks5ServerContext(ctx context.Context, socks5Address string) error {
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l, serverSocks, err := s.listenSocks5(dialCtx, socks5Address)
+	if err == errClosing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cl := &closeAllListener{Listener: l, conns: make(map[net.Conn]struct{})}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cl.closeAll()
+		case <-stopped:
+		}
+	}()
+
+	err = s.serveSocks5(cl, serverSocks)
+	s.untrackListener(l)
+	if ctx.Err() != nil {
+		s.status.CompareAndSwap(int64(StatusSocks5Running), int64(StatusConnected))
+		return nil
+	}
+	return err
+}
+
+// closeAllListener remembers the conns it accepted so they can be closed
+// together with the listener.
+type closeAllListener struct {
+	net.Listener
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+}
+
+func (l *closeAllListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	conn := &closeAllConn{Conn: c, l: l}
+	l.conns[conn] = struct{}{}
+	return conn, nil
+}
+
+func (l *closeAllListener) closeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.Listener.Close()
+	for c := range l.conns {
+		c.(*closeAllConn).Conn.Close()
+	}
+}
+
+type closeAllConn struct {
+	net.Conn
+	l *closeAllListener
+}
+
+func (c *closeAllConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// listenSocks5 listens for a socks5 server whose dials give up once ctx is
+// done, callers cancel it when the server stops.
+func (s *SSHConn) listenSocks5(ctx context.Context, socks5Address string) (net.Listener, *socks5.Server, error) {
+	if _, err := s.client(); err != nil {
+		return nil, nil, err
+	}
+	if !s.AllowNonLoopback {
+		loopback, err := isLoopbackAddr(socks5Address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid socks5 address %s: %v", socks5Address, err)
+		}
+		if !loopback {
+			return nil, nil, fmt.Errorf("refusing to listen socks5 server on non-loopback address %s, set AllowNonLoopback to override", socks5Address)
+		}
+	}
+	var resolver socks5.NameResolver = remoteResolver{}
+	if s.ResolveRemoteLocally {
+		resolver = socks5.DNSResolver{}
 	}
 	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return s.sshClient.Dial(network, addr)
+		Resolver: resolver,
+		// go-socks5 always passes context.Background(), dial with the
+		// server's context so dials in flight end when it stops
+		Dial: func(_ context.Context, network, addr string) (net.Conn, error) {
+			if err := s.acquireSocksSlot(addr); err != nil {
+				s.logf("%s", err)
+				return nil, err
+			}
+			c, err := s.dialRemoteContext(ctx, network, addr)
+			if err != nil {
+				s.releaseSocksSlot()
+				return nil, err
+			}
+			if s.LogConnections {
+				s.logf("socks5 -> %s", addr)
+			}
+			if !s.trackConn(c) {
+				s.releaseSocksSlot()
+				return nil, errClosing
+			}
+			return s.countSocksConn(&trackedConn{Conn: c, s: s}, addr), nil
 		},
 	}
 
 	serverSocks, err := socks5.New(conf)
 
 	if err != nil {
-		return fmt.Errorf("failed to create socks5 server %v", err)
+		return nil, nil, fmt.Errorf("failed to create socks5 server %v", err)
 	}
 
-	l, err := net.Listen("tcp", socks5Address)
+	l, err := s.listen(socks5Address)
 
 	if err != nil {
-		return fmt.Errorf("failed to listen socks5 server on %s, %v", socks5Address, err)
+		return nil, nil, fmt.Errorf("failed to listen socks5 server on %s, %v", socks5Address, err)
 	}
-	s.status = 2
+	if !s.trackListener(l) {
+		return nil, nil, errClosing
+	}
+	return l, serverSocks, nil
+}
+
+func (s *SSHConn) serveSocks5(l net.Listener, serverSocks *socks5.Server) error {
+	defer s.untrackListener(l)
+	s.status.CompareAndSwap(int64(StatusConnected), int64(StatusSocks5Running))
 
 	if err := serverSocks.Serve(l); err != nil {
+		if s.acceptStopped() {
+			return nil
+		}
 		return fmt.Errorf("failed to start socks5 server %v", err)
 	}
 	return nil
 }
+
+// remoteResolver leaves host names unresolved so they are passed on to the
+// ssh server and resolved in its network, which is what makes names only
+// known there (split horizon dns) work through the proxy.
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// isLoopbackAddr reports whether every address host:port may bind to is a
+// loopback address. An empty host listens on all interfaces and is not.
+func isLoopbackAddr(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	if host == "" {
+		return false, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback(), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false, nil
+		}
+	}
+	return len(ips) > 0, nil
+}
+
+const (
+	socks5Granted     = 0
+	socks5Failure     = 1
+	socks5NotAllowed  = 2
+	socks5BadAddrType = 8
+)
+
+// serveSocks5Conn handles a socks5 client of StartSocksServer. BIND, which
+// the socks5 library does not implement, is served here, all other
+// requests are passed on to serverSocks.
+func (s *SSHConn) serveSocks5Conn(conn *peekedConn, serverSocks *socks5.Server) error {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn.r, greeting); err != nil {
+		return fmt.Errorf("failed to read socks5 greeting: %v", err)
+	}
+	greeting = append(greeting, make([]byte, greeting[1])...)
+	if _, err := io.ReadFull(conn.r, greeting[2:]); err != nil {
+		return fmt.Errorf("failed to read socks5 greeting: %v", err)
+	}
+	if bytes.IndexByte(greeting[2:], 0) < 0 {
+		// no acceptable method, the library refuses the client
+		return serverSocks.ServeConn(&replayConn{peekedConn: conn, replay: greeting})
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+	req, err := conn.r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("failed to read socks5 request: %v", err)
+	}
+	if req[1] != 2 {
+		// the library answers the greeting again, that reply was sent already
+		return serverSocks.ServeConn(&replayConn{peekedConn: conn, replay: greeting, skip: 2})
+	}
+
+	conn.r.Discard(3)
+	peer, err := readSocks5Addr(conn.r)
+	if err != nil {
+		writeSocks5Reply(conn, socks5BadAddrType, nil)
+		return err
+	}
+	return s.serveSocks5Bind(conn, peer)
+}
+
+// serveSocks5Bind handles a socks5 BIND request like serveSocks4Bind,
+// listening on IPv6 if peer is an IPv6 address.
+func (s *SSHConn) serveSocks5Bind(conn *peekedConn, peer net.IP) error {
+	listener, bound, err := s.listenBind(conn, peer.To4() == nil)
+	if err != nil {
+		writeSocks5Reply(conn, socks5Failure, nil)
+		return err
+	}
+	defer s.untrackListener(listener)
+	defer listener.Close()
+	if err := writeSocks5Reply(conn, socks5Granted, bound); err != nil {
+		return err
+	}
+
+	remote, from, err := s.acceptBind(conn, listener, peer)
+	if err != nil {
+		writeSocks5Reply(conn, socks5NotAllowed, nil)
+		return err
+	}
+	defer s.untrackConn(remote)
+	defer remote.Close()
+	if err := writeSocks5Reply(conn, socks5Granted, from); err != nil {
+		return err
+	}
+	s.pipe(conn, remote, nil)
+	return nil
+}
+
+// readSocks5Addr reads the address of a socks5 request. A host name cannot
+// be checked against the peer of a BIND and is returned as 0.0.0.0.
+func readSocks5Addr(r *bufio.Reader) (net.IP, error) {
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read socks5 request: %v", err)
+	}
+	var ip net.IP
+	switch atyp {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 4:
+		ip = make(net.IP, net.IPv6len)
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read socks5 request: %v", err)
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return nil, fmt.Errorf("failed to read socks5 request: %v", err)
+		}
+		ip = net.IPv4zero
+	default:
+		return nil, fmt.Errorf("unsupported socks5 address type %d", atyp)
+	}
+	if atyp != 3 {
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, fmt.Errorf("failed to read socks5 request: %v", err)
+		}
+	}
+	if _, err := r.Discard(2); err != nil { // port
+		return nil, fmt.Errorf("failed to read socks5 request: %v", err)
+	}
+	return ip, nil
+}
+
+// writeSocks5Reply sends code and addr, with an IPv4 or IPv6 address type
+// after the family of addr, or 0.0.0.0:0 if addr is nil.
+func writeSocks5Reply(w io.Writer, code byte, addr *net.TCPAddr) error {
+	ip, port := net.IP(net.IPv4zero.To4()), 0
+	if addr != nil {
+		ip, port = addr.IP.To4(), addr.Port
+		if ip == nil {
+			ip = addr.IP.To16()
+		}
+	}
+	reply := []byte{5, code, 0, 1}
+	if len(ip) == net.IPv6len {
+		reply[3] = 4
+	}
+	reply = append(reply, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// replayConn hands bytes already read from a peekedConn back to the socks5
+// library and drops the first skip bytes it writes.
+type replayConn struct {
+	*peekedConn
+	replay []byte
+	skip   int
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(p, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	return c.peekedConn.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	if c.skip > 0 {
+		n := len(p)
+		if n > c.skip {
+			n = c.skip
+		}
+		c.skip -= n
+		if n == len(p) {
+			return n, nil
+		}
+		written, err := c.peekedConn.Write(p[n:])
+		return n + written, err
+	}
+	return c.peekedConn.Write(p)
+}
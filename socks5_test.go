@@ -0,0 +1,353 @@
+package sshts
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kslamph/sshts/testutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+func dialSocks5(t *testing.T, proxyAddr, target string) net.Conn {
+	t.Helper()
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSocks5LoopbackOnly(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	tests := []struct {
+		addr             string
+		allowNonLoopback bool
+		ok               bool
+	}{
+		{"127.0.0.1:0", false, true},
+		{"localhost:0", false, true},
+		{"0.0.0.0:0", false, false},
+		{":0", false, false},
+		{"0.0.0.0:0", true, true},
+	}
+	for _, tt := range tests {
+		s.AllowNonLoopback = tt.allowNonLoopback
+		l, _, err := s.listenSocks5(context.Background(), tt.addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("listen on %s with AllowNonLoopback %v: %v", tt.addr, tt.allowNonLoopback, err)
+		}
+		if err == nil {
+			s.untrackListener(l)
+			l.Close()
+		}
+	}
+}
+
+// Run with -race: status and the connection state are shared by these
+// goroutines.
+func TestConnectSocksCloseConcurrent(t *testing.T) {
+	srv := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		s := newTestConn(t, srv)
+		socksDone := make(chan struct{})
+		go func() {
+			defer close(socksDone)
+			s.StartSocks5Server("127.0.0.1:0")
+		}()
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.Connect()
+		}()
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.GetStatus()
+			}
+		}()
+		wg.Wait()
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-socksDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("socks5 server still running after Close")
+		}
+		if st := s.GetStatus(); st != StatusDisconnected {
+			t.Fatalf("status %s after Close", st)
+		}
+	}
+}
+
+func TestSocksStats(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startSocksTestServer(t, s.StartSocks5Server)
+
+	conn := dialSocks5(t, addr, srv.EchoAddr)
+	data := bytes.Repeat([]byte("x"), 10000)
+	go conn.Write(data)
+	if _, err := io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	st := s.SocksStats()
+	if st.Active != 1 || len(st.Conns) != 1 {
+		t.Fatalf("%d active, %d listed, want 1", st.Active, len(st.Conns))
+	}
+	if c := st.Conns[0]; c.Target != srv.EchoAddr || c.BytesIn != 10000 || c.BytesOut != 10000 {
+		t.Fatalf("connection stats %+v", c)
+	}
+
+	conn.Close()
+	eventually(t, "connection to end", func() bool { return s.SocksStats().Active == 0 })
+	st = s.SocksStats()
+	if st.Total != 1 || st.BytesIn != 10000 || st.BytesOut != 10000 {
+		t.Fatalf("totals %+v", st)
+	}
+}
+
+func TestMaxSocksConnections(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxSocksConnections = 2
+	addr := startSocksTestServer(t, s.StartSocks5Server)
+
+	first := dialSocks5(t, addr, srv.EchoAddr)
+	echo(t, first, "a")
+	echo(t, dialSocks5(t, addr, srv.EchoAddr), "b")
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialer.Dial("tcp", srv.EchoAddr); err == nil {
+		conn.Close()
+		t.Fatal("connection over MaxSocksConnections was proxied")
+	}
+	if n := s.RejectedConnections(); n != 1 {
+		t.Fatalf("%d rejected connections, want 1", n)
+	}
+
+	first.Close()
+	eventually(t, "slot to be released", func() bool { return s.SocksStats().Active == 1 })
+	echo(t, dialSocks5(t, addr, srv.EchoAddr), "c")
+}
+
+func TestSocks5ServerContextCancel(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	addr := startSocksTestServer(t, func(addr string) error {
+		err := s.StartSocks5ServerContext(ctx, addr)
+		stopped <- err
+		return err
+	})
+
+	conn := dialSocks5(t, addr, srv.EchoAddr)
+	echo(t, conn, "hello")
+	if st := s.GetStatus(); st != StatusSocks5Running {
+		t.Fatalf("status %s while serving", st)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socks5 server still running after cancel")
+	}
+	if !refused(conn) {
+		t.Fatal("in-flight connection still open after cancel")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener still open after cancel")
+	}
+	if st := s.GetStatus(); st != StatusConnected {
+		t.Fatalf("status %s after cancel, want connected", st)
+	}
+}
+
+func TestSocks5ServerContextCancelAndClose(t *testing.T) {
+	orders := map[string]func(s *SSHConn, cancel context.CancelFunc){
+		"cancel then close": func(s *SSHConn, cancel context.CancelFunc) {
+			cancel()
+			s.Close()
+		},
+		"close then cancel": func(s *SSHConn, cancel context.CancelFunc) {
+			s.Close()
+			cancel()
+		},
+		"at once": func(s *SSHConn, cancel context.CancelFunc) {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() { defer wg.Done(); cancel() }()
+			go func() { defer wg.Done(); s.Close() }()
+			wg.Wait()
+		},
+	}
+	for name, stop := range orders {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t)
+			s := connectTestConn(t, srv)
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan error, 1)
+			addr := startSocksTestServer(t, func(addr string) error {
+				err := s.StartSocks5ServerContext(ctx, addr)
+				stopped <- err
+				return err
+			})
+			conn := dialSocks5(t, addr, srv.EchoAddr)
+			echo(t, conn, "hello")
+
+			stop(s, cancel)
+			select {
+			case err := <-stopped:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("socks5 server still running")
+			}
+			if !refused(conn) {
+				t.Fatal("connection still open")
+			}
+			if st := s.GetStatus(); st != StatusDisconnected {
+				t.Fatalf("status %s, want disconnected", st)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("second Close: %v", err)
+			}
+		})
+	}
+}
+
+func TestSocks5ResolvesOnServer(t *testing.T) {
+	srv := newTestServer(t)
+	_, port, _ := net.SplitHostPort(srv.EchoAddr)
+	target := net.JoinHostPort("localhost", port)
+	for _, local := range []bool{false, true} {
+		s := connectTestConn(t, srv)
+		s.ResolveRemoteLocally = local
+		addr := startSocksTestServer(t, func(addr string) error { return s.StartSocks5Server(addr) })
+
+		echo(t, dialSocks5(t, addr, target), "resolved")
+		targets := srv.Targets()
+		host, _, _ := net.SplitHostPort(targets[len(targets)-1])
+		if resolved := net.ParseIP(host) != nil; resolved != local {
+			t.Fatalf("server asked for %s with ResolveRemoteLocally %v", host, local)
+		}
+	}
+}
+
+// socksSlots is the number of socks connections dialing or open.
+func socksSlots(s *SSHConn) int {
+	s.socks.mu.Lock()
+	defer s.socks.mu.Unlock()
+	return s.socks.slots
+}
+
+// abandonedDial starts a socks5 dial that the server holds and returns once
+// the ssh server is answering the channel open.
+func abandonedDial(t *testing.T, srv *testutil.Server, proxyAddr string) <-chan error {
+	t.Helper()
+	srv.HoldChannels()
+	t.Cleanup(srv.ReleaseChannels)
+	dialed := make(chan error, 1)
+	go func() {
+		dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = dialer.Dial("tcp", srv.EchoAddr); err == nil {
+				conn.Close()
+			}
+		}
+		dialed <- err
+	}()
+	eventually(t, "the channel open to reach the server", func() bool { return srv.MaxConcurrentOpens() == 1 })
+	return dialed
+}
+
+func TestSocks5ServerContextCancelDuringDial(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startSocksTestServer(t, func(addr string) error { return s.StartSocks5ServerContext(ctx, addr) })
+
+	dialed := abandonedDial(t, srv, addr)
+	cancel()
+	eventually(t, "the dial to be given up", func() bool { return socksSlots(s) == 0 })
+	if err := <-dialed; err == nil {
+		t.Fatal("socks5 dial succeeded after cancel")
+	}
+
+	// the channel opened after that is closed right away
+	srv.ReleaseChannels()
+	eventually(t, "the late channel to be closed", func() bool {
+		accepted, open := srv.ChannelCounts()
+		return accepted == 1 && open == 0
+	})
+}
+
+func TestSocks5ServerCloseDuringDial(t *testing.T) {
+	srv := newTestServer(t)
+	// a borrowed client stays open on Close, so only the server's context
+	// can end the dial
+	client, err := ssh.Dial("tcp", srv.Addr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(srv.ClientSigner)},
+		HostKeyCallback: ssh.FixedHostKey(srv.HostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s := NewFromClient(client)
+	s.Logger = log.New(io.Discard, "", 0)
+	addr := startSocksTestServer(t, s.StartSocks5Server)
+
+	dialed := abandonedDial(t, srv, addr)
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the dial in flight")
+	}
+	eventually(t, "the dial to be given up", func() bool { return socksSlots(s) == 0 })
+	if err := <-dialed; err == nil {
+		t.Fatal("socks5 dial succeeded after Close")
+	}
+
+	srv.ReleaseChannels()
+	eventually(t, "the late channel to be closed", func() bool {
+		accepted, open := srv.ChannelCounts()
+		return accepted == 1 && open == 0
+	})
+}
@@ -0,0 +1,92 @@
+package sshts
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+// startSocksProxy runs a socks5 proxy dialing directly, requiring a
+// password if creds is not nil, and returns its address and the targets
+// it connected to.
+func startSocksProxy(t *testing.T, creds socks5.StaticCredentials) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var targets []string
+	conf := &socks5.Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			targets = append(targets, addr)
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	if creds != nil {
+		conf.AuthMethods = []socks5.Authenticator{socks5.UserPassAuthenticator{Credentials: creds}}
+	}
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	return l.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), targets...)
+	}
+}
+
+func TestSocksProxy(t *testing.T) {
+	srv := newTestServer(t)
+	proxyAddr, targets := startSocksProxy(t, nil)
+	s := newTestConn(t, srv)
+	s.SocksProxy = proxyAddr
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(); len(got) != 1 || got[0] != srv.Addr {
+		t.Fatalf("proxy connected to %q, want %s", got, srv.Addr)
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "through the proxy")
+}
+
+func TestSocksProxyAuth(t *testing.T) {
+	srv := newTestServer(t)
+	proxyAddr, targets := startSocksProxy(t, socks5.StaticCredentials{"user": "secret"})
+
+	s := newTestConn(t, srv)
+	s.SocksProxy = "socks5://user:wrong@" + proxyAddr
+	if err := s.Connect(); err == nil {
+		t.Fatal("connected with the wrong proxy password")
+	}
+	s.SocksProxy = "socks5://user:secret@" + proxyAddr
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(); len(got) != 1 || got[0] != srv.Addr {
+		t.Fatalf("proxy connected to %q, want %s", got, srv.Addr)
+	}
+}
+
+func TestSocksProxyInvalid(t *testing.T) {
+	srv := newTestServer(t)
+	for _, proxyAddr := range []string{"http://" + srv.Addr, closedAddr(t)} {
+		s := newTestConn(t, srv)
+		s.SocksProxy = proxyAddr
+		err := s.Connect()
+		if err == nil || !strings.Contains(err.Error(), "socks proxy") {
+			t.Errorf("proxy %s: got %v, want a socks proxy error", proxyAddr, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package sshts
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// SocksStats are the counters of the socks servers. BytesIn is data
+// received through ssh, BytesOut data sent into it.
+type SocksStats struct {
+	Active   int64
+	Total    int64
+	BytesIn  int64
+	BytesOut int64
+	// Conns lists the connections currently proxied.
+	Conns []SocksConnStats
+}
+
+// SocksConnStats are the counters of one proxied connection.
+type SocksConnStats struct {
+	Target   string
+	BytesIn  int64
+	BytesOut int64
+}
+
+type socksStats struct {
+	total    atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu    sync.Mutex
+	conns map[*socksConn]struct{}
+	slots int
+}
+
+// SocksStats returns the counters of the connections proxied by the socks
+// servers.
+func (s *SSHConn) SocksStats() SocksStats {
+	st := SocksStats{
+		Total:    s.socks.total.Load(),
+		BytesIn:  s.socks.bytesIn.Load(),
+		BytesOut: s.socks.bytesOut.Load(),
+	}
+	s.socks.mu.Lock()
+	defer s.socks.mu.Unlock()
+	st.Active = int64(len(s.socks.conns))
+	for c := range s.socks.conns {
+		st.Conns = append(st.Conns, SocksConnStats{
+			Target:   c.target,
+			BytesIn:  c.counters.bytesIn.Load(),
+			BytesOut: c.counters.bytesOut.Load(),
+		})
+	}
+	return st
+}
+
+// acquireSocksSlot reserves one of the MaxSocksConnections slots. The slot
+// is released by closing the conn returned by countSocksConn, or by
+// releaseSocksSlot if the dial failed.
+func (s *SSHConn) acquireSocksSlot(target string) error {
+	s.socks.mu.Lock()
+	defer s.socks.mu.Unlock()
+	if s.MaxSocksConnections > 0 && s.socks.slots >= s.MaxSocksConnections {
+		err := fmt.Errorf("socks connection to %s rejected, max connections %d reached", target, s.MaxSocksConnections)
+		s.stats.rejected.Add(1)
+		s.setLastError(err)
+		return err
+	}
+	s.socks.slots++
+	return nil
+}
+
+func (s *SSHConn) releaseSocksSlot() {
+	s.socks.mu.Lock()
+	s.socks.slots--
+	s.socks.mu.Unlock()
+}
+
+// countSocksConn wraps conn, the remote side of a socks connection to
+// target, so its data shows in SocksStats until it is closed.
+func (s *SSHConn) countSocksConn(conn net.Conn, target string) net.Conn {
+	c := &socksConn{Conn: conn, s: s, target: target}
+	s.socks.total.Add(1)
+	s.socks.mu.Lock()
+	if s.socks.conns == nil {
+		s.socks.conns = make(map[*socksConn]struct{})
+	}
+	s.socks.conns[c] = struct{}{}
+	s.socks.mu.Unlock()
+	return c
+}
+
+type socksConn struct {
+	net.Conn
+	s        *SSHConn
+	target   string
+	counters byteCounters
+	once     sync.Once
+}
+
+func (c *socksConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.s.socks.bytesIn.Add(int64(n))
+	c.counters.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *socksConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.s.socks.bytesOut.Add(int64(n))
+	c.counters.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *socksConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *socksConn) Close() error {
+	c.once.Do(func() {
+		c.s.socks.mu.Lock()
+		delete(c.s.socks.conns, c)
+		c.s.socks.slots--
+		c.s.socks.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,182 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseForwardSpec parses an OpenSSH -L style forward spec,
+// [bind_address:]port:host:hostport, e.g. "8080:localhost:80" or
+// "127.0.0.1:8080:db:5432". IPv6 addresses are written in brackets. Without
+// a bind address the local side listens on localhost, like ssh does.
+func ParseForwardSpec(spec string) (localAddr, remoteAddr string, err error) {
+	fields, err := splitSpec(spec)
+	if err != nil {
+		return "", "", err
+	}
+	bind := "localhost"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind = fields[0]
+		fields = fields[1:]
+	default:
+		return "", "", fmt.Errorf("invalid forward spec %q: want [bind_address:]port:host:hostport", spec)
+	}
+	for _, f := range fields {
+		if f == "" {
+			return "", "", fmt.Errorf("invalid forward spec %q: empty field", spec)
+		}
+	}
+	return net.JoinHostPort(bind, fields[0]), net.JoinHostPort(fields[1], fields[2]), nil
+}
+
+// StartTunnelSpec is StartTunnel with the addresses given as an -L style
+// spec, see ParseForwardSpec.
+func (s *SSHConn) StartTunnelSpec(spec string) error {
+	local, remote, err := ParseForwardSpec(spec)
+	if err != nil {
+		return err
+	}
+	return s.StartTunnel(local, remote)
+}
+
+// StartForwards sets up several forwards over the connection, each given as
+// an ssh style spec prefixed with its kind:
+//
+//	L[bind_address:]port:host:hostport  local forward, like ssh -L
+//	R[bind_address:]port:host:hostport  remote forward, like ssh -R
+//	D[bind_address:]port                socks5 proxy, like ssh -D
+//
+// A leading "-" and spaces after the kind are allowed, so "-L 8080:db:5432"
+// works too. StartForwards returns once every forward is listening; the
+// forwards then run until the SSHConn is closed. Forwards that could not be
+// started are reported together in the returned error, the others keep
+// running.
+func (s *SSHConn) StartForwards(specs []string) error {
+	var errs []error
+	for _, spec := range specs {
+		if err := s.startForward(spec); err != nil {
+			errs = append(errs, fmt.Errorf("forward %q: %w", spec, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SSHConn) startForward(spec string) error {
+	kind, listen, target, err := parseForward(spec)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case 'L':
+		listener, err := s.listenTunnel(listen)
+		if err != nil {
+			return err
+		}
+		s.serveInBackground(func() error { return s.serveTunnel(listener, target) })
+	case 'R':
+		if _, err := s.StartReverseTunnel(listen, target); err != nil {
+			return err
+		}
+	case 'D':
+		ctx, cancel := context.WithCancel(context.Background())
+		l, serverSocks, err := s.listenSocks5(ctx, listen)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.serveInBackground(func() error {
+			defer cancel()
+			return s.serveSocks5(l, serverSocks)
+		})
+	}
+	return nil
+}
+
+// parseForward parses a spec for StartForwards into its kind, the address
+// to listen on and, except for D, the address to forward to.
+func parseForward(spec string) (kind byte, listen, target string, err error) {
+	spec = strings.TrimPrefix(strings.TrimSpace(spec), "-")
+	if spec == "" {
+		return 0, "", "", fmt.Errorf("empty forward spec")
+	}
+	kind, rest := spec[0], strings.TrimSpace(spec[1:])
+
+	switch kind {
+	case 'L', 'R':
+		listen, target, err = ParseForwardSpec(rest)
+	case 'D':
+		listen, err = parseDynamicSpec(rest)
+	default:
+		err = fmt.Errorf("unknown forward kind %q, want L, R or D", kind)
+	}
+	return kind, listen, target, err
+}
+
+func (s *SSHConn) serveInBackground(serve func() error) {
+	s.spawn(func() {
+		if err := serve(); err != nil {
+			s.logf("forward stopped: %s", err)
+		}
+	})
+}
+
+// parseDynamicSpec parses [bind_address:]port.
+func parseDynamicSpec(spec string) (string, error) {
+	fields, err := splitSpec(spec)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(fields) == 1 && fields[0] != "":
+		return net.JoinHostPort("localhost", fields[0]), nil
+	case len(fields) == 2 && fields[1] != "":
+		return net.JoinHostPort(fields[0], fields[1]), nil
+	}
+	return "", fmt.Errorf("invalid dynamic forward spec %q: want [bind_address:]port", spec)
+}
+
+// splitSpec splits spec on colons that are not inside [] brackets and
+// strips the brackets.
+func splitSpec(spec string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	inBracket := false
+	for _, r := range spec {
+		switch {
+		case r == '[' && !inBracket:
+			inBracket = true
+		case r == ']' && inBracket:
+			inBracket = false
+		case r == ':' && !inBracket:
+			fields = append(fields, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if inBracket {
+		return nil, fmt.Errorf("invalid forward spec %q: unclosed bracket", spec)
+	}
+	return append(fields, cur.String()), nil
+}
+
+// normalizeRemoteAddr turns a remote address given as just a port, "5432"
+// or ":5432", into the loopback address of the ssh server.
+func normalizeRemoteAddr(addr string) string {
+	port := strings.TrimPrefix(addr, ":")
+	if port == "" {
+		return addr
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return addr
+		}
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
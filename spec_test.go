@@ -0,0 +1,102 @@
+package sshts
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec          string
+		local, remote string
+	}{
+		{"8080:localhost:80", "localhost:8080", "localhost:80"},
+		{"127.0.0.1:8080:db:5432", "127.0.0.1:8080", "db:5432"},
+		{"[::1]:8080:[2001:db8::1]:443", "[::1]:8080", "[2001:db8::1]:443"},
+	}
+	for _, tt := range tests {
+		local, remote, err := ParseForwardSpec(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if local != tt.local || remote != tt.remote {
+			t.Errorf("%q: got %s, %s, want %s, %s", tt.spec, local, remote, tt.local, tt.remote)
+		}
+	}
+}
+
+func TestParseForwardSpecInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"8080",
+		"8080:db",
+		"a:b:c:d:e",
+		"8080::5432",
+		"[::1:8080:db:5432",
+	} {
+		if local, remote, err := ParseForwardSpec(spec); err == nil {
+			t.Errorf("%q: got %s, %s, want an error", spec, local, remote)
+		}
+	}
+}
+
+func TestNormalizeRemoteAddr(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"5432", "127.0.0.1:5432"},
+		{":5432", "127.0.0.1:5432"},
+		{"host:5432", "host:5432"},
+		{"[::1]:5432", "[::1]:5432"},
+		{"", ""},
+		{":", ":"},
+		{"db", "db"},
+	}
+	for _, tt := range tests {
+		if got := normalizeRemoteAddr(tt.addr); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestStartForwards(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	local, remote, socks := closedAddr(t), closedAddr(t), closedAddr(t)
+	err := s.StartForwards([]string{
+		"L" + local + ":" + srv.EchoAddr,
+		"-R " + remote + ":" + srv.EchoAddr,
+		"D" + socks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{local, remote} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "via "+addr)
+	}
+	echo(t, dialSocks5(t, socks, srv.EchoAddr), "via socks")
+}
+
+func TestStartForwardsPartialFailure(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	local := closedAddr(t)
+	err := s.StartForwards([]string{"X1234", "L" + local + ":" + srv.EchoAddr})
+	if err == nil || !strings.Contains(err.Error(), `"X1234"`) {
+		t.Fatalf("got %v, want an error naming the bad spec", err)
+	}
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "still forwarded")
+}
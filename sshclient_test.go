@@ -0,0 +1,621 @@
+package sshts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// flakyProxy forwards connections to target, except for the first fail
+// ones which are closed right away, like a server that is still starting.
+func flakyProxy(t *testing.T, target string, fail int32) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var attempts atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if attempts.Add(1) <= fail {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+				go io.Copy(backend, conn)
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+	return l.Addr().String(), &attempts
+}
+
+func TestConnectRetries(t *testing.T) {
+	srv := newTestServer(t)
+	addr, attempts := flakyProxy(t, srv.Addr, 1)
+
+	s := newTestConn(t, srv)
+	s.serverAddr = addr
+	s.ConnectRetries = 3
+	s.ConnectRetryBackoff = 10 * time.Millisecond
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("connected after %d attempts, want 2", n)
+	}
+}
+
+func TestConnectNoRetries(t *testing.T) {
+	srv := newTestServer(t)
+	addr, attempts := flakyProxy(t, srv.Addr, 1)
+
+	s := newTestConn(t, srv)
+	s.serverAddr = addr
+	if err := s.Connect(); err == nil {
+		t.Fatal("connected to a server that was not up")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("%d attempts, want 1", n)
+	}
+}
+
+func TestConnectContextCancelDuringHandshake(t *testing.T) {
+	srv := newTestServer(t)
+	// accepts tcp connections but never answers the ssh handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	before := runtime.NumGoroutine()
+	s := newTestConn(t, srv)
+	s.serverAddr = l.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.ConnectContext(ctx) }()
+	conn := <-accepted
+	defer conn.Close()
+	cancel()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectContext did not return after cancel")
+	}
+	if s.GetStatus() != StatusDisconnected {
+		t.Fatalf("status %s after cancelled connect", s.GetStatus())
+	}
+	eventually(t, "handshake goroutine to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+func TestCloseTwice(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if s.GetStatus() != StatusDisconnected {
+		t.Fatalf("status %s after Close", s.GetStatus())
+	}
+}
+
+func TestCloseBeforeConnect(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetStatus() != StatusConnected {
+		t.Fatalf("status %s after Connect", s.GetStatus())
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	startTestTunnel(t, s, srv.EchoAddr)
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- s.Close() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.GetStatus() != StatusDisconnected {
+		t.Fatalf("status %s after Close", s.GetStatus())
+	}
+}
+
+func TestCloseAfterReconnect(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetStatus() != StatusDisconnected {
+		t.Fatalf("status %s after the second Close", s.GetStatus())
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("tunnel still listening after the second Close")
+	}
+}
+
+func TestReasonClosedByUser(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	if err := s.Reason(); err != nil {
+		t.Fatalf("Reason %v while connected", err)
+	}
+	s.Close()
+	waitDone(t, s)
+	if err := s.Reason(); err != ErrClosedByUser {
+		t.Fatalf("Reason %v, want ErrClosedByUser", err)
+	}
+}
+
+func TestReasonConnectionLost(t *testing.T) {
+	for _, autoReconnect := range []bool{false, true} {
+		srv := newTestServer(t)
+		s := connectTestConn(t, srv)
+		s.AutoReconnect = autoReconnect
+		addr := startTestTunnel(t, s, srv.EchoAddr)
+
+		// the server goes away for good, a reconnect fails too
+		srv.Close()
+		waitDone(t, s)
+		if err := s.Reason(); !errors.Is(err, ErrConnectionLost) {
+			t.Fatalf("Reason %v with AutoReconnect %v, want ErrConnectionLost", err, autoReconnect)
+		}
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Fatalf("tunnel still listening after the loss with AutoReconnect %v", autoReconnect)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close after the loss: %v", err)
+		}
+	}
+}
+
+func TestNewFromKeyBytes(t *testing.T) {
+	srv := newTestServer(t)
+	s, err := NewFromKeyBytes("test", srv.ClientKeyPEM, srv.Addr, ssh.FixedHostKey(srv.HostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, dial(t, startTestTunnel(t, s, srv.EchoAddr)), "pem key")
+
+	if _, err := NewFromKeyBytes("test", []byte("not a key"), srv.Addr, nil); err == nil {
+		t.Fatal("bad key bytes accepted")
+	}
+}
+
+func TestCompressionUnsupported(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	s.Compression = true
+	if err := s.Connect(); !errors.Is(err, ErrCompressionUnsupported) {
+		t.Fatalf("got %v, want ErrCompressionUnsupported", err)
+	}
+	if s.Client() != nil {
+		t.Fatal("connected although compression was requested")
+	}
+
+	s.Compression = false
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if s.Client() != nil {
+		t.Fatal("Client is not nil before Connect")
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	client := s.Client()
+	if client == nil {
+		t.Fatal("Client is nil after Connect")
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("request on the returned client: %v", err)
+	}
+	s.Close()
+	if s.Client() != nil {
+		t.Fatal("Client is not nil after Close")
+	}
+}
+
+func TestBannerCallback(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetBanner("authorized use only\n")
+
+	var banner string
+	s := newTestConn(t, srv)
+	s.BannerCallback = func(message string) error {
+		banner = message
+		return nil
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if banner != "authorized use only\n" {
+		t.Fatalf("banner %q", banner)
+	}
+
+	// an error from the callback aborts the connection
+	s = newTestConn(t, srv)
+	s.BannerCallback = func(string) error { return errors.New("banner rejected") }
+	if err := s.Connect(); err == nil || !strings.Contains(err.Error(), "banner rejected") {
+		t.Fatalf("got %v, want the callback's error", err)
+	}
+}
+
+func TestWaitReturnsAfterClose(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	startTestTunnel(t, s, srv.EchoAddr)
+
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while connected")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Close")
+	}
+}
+
+func TestNewFromClient(t *testing.T) {
+	srv := newTestServer(t)
+	client, err := ssh.Dial("tcp", srv.Addr, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(srv.ClientSigner)},
+		HostKeyCallback: ssh.FixedHostKey(srv.HostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s := NewFromClient(client)
+	s.Logger = log.New(io.Discard, "", 0)
+	if s.GetStatus() != StatusConnected {
+		t.Fatalf("status %v, want connected", s.GetStatus())
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "borrowed")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the client stays owned by the caller
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("client closed by Close: %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("tunnel still listening after Close")
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if st := s.GetStatus(); st != StatusDisconnected {
+		t.Fatalf("status %s before Connect", st)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.GetStatus(); st != StatusConnected {
+		t.Fatalf("status %s after Connect", st)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startSocksTestServer(t, func(addr string) error {
+		return s.StartSocks5ServerContext(ctx, addr)
+	})
+	echo(t, dialSocks5(t, addr, srv.EchoAddr), "hello")
+	if st := s.GetStatus(); st != StatusSocks5Running {
+		t.Fatalf("status %s while the socks5 server runs", st)
+	}
+	cancel()
+	eventually(t, "status to go back to connected", func() bool { return s.GetStatus() == StatusConnected })
+
+	// a lost connection is reported as disconnected
+	srv.Close()
+	eventually(t, "status to become disconnected", func() bool { return s.GetStatus() == StatusDisconnected })
+
+	s.Close()
+	if st := s.GetStatus(); st != StatusDisconnected {
+		t.Fatalf("status %s after Close", st)
+	}
+}
+
+func TestStatusString(t *testing.T) {
+	for st, want := range map[Status]string{
+		StatusDisconnected:  "disconnected",
+		StatusConnected:     "connected",
+		StatusSocks5Running: "socks5 running",
+		Status(7):           "Status(7)",
+	} {
+		if got := st.String(); got != want {
+			t.Errorf("%d: got %q, want %q", int64(st), got, want)
+		}
+	}
+}
+
+func TestConnectRetryJitter(t *testing.T) {
+	s := &SSHConn{}
+	if d := s.retryWait(time.Second); d != time.Second {
+		t.Fatalf("wait %v without jitter, want the backoff", d)
+	}
+	s.ConnectRetryJitter = true
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		d := s.retryWait(time.Second)
+		if d < 0 || d > time.Second {
+			t.Fatalf("wait %v outside [0, 1s]", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 100 {
+		t.Fatalf("only %d distinct waits in 1000 retries", len(seen))
+	}
+	if d := s.retryWait(0); d != 0 {
+		t.Fatalf("wait %v for no backoff", d)
+	}
+}
+
+func TestConnectRetryJitterFakeClock(t *testing.T) {
+	s := newTestConn(t, newTestServer(t))
+	s.serverAddr = closedAddr(t)
+	clk := newFakeClock()
+	s.clock = clk
+	s.ConnectRetries = 3
+	s.ConnectRetryBackoff = time.Second
+	s.ConnectRetryJitter = true
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Connect() }()
+	// each wait is up to the doubled backoff
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		clk.waitTimers(t, 1)
+		clk.mu.Lock()
+		wait := clk.timers[0].at.Sub(clk.now)
+		clk.mu.Unlock()
+		if wait < 0 || wait > backoff {
+			t.Fatalf("waiting %v, want at most %v", wait, backoff)
+		}
+		clk.Advance(backoff)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("connected to a closed port")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect did not give up after the retries")
+	}
+}
+
+func TestOnConnectionLost(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	lost := make(chan error, 2)
+	s.OnConnectionLost = func(err error) { lost <- err }
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Close()
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Fatal("OnConnectionLost called without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnConnectionLost not called after the server dropped the connection")
+	}
+	if st := s.GetStatus(); st != StatusDisconnected {
+		t.Fatalf("status %v, want disconnected", st)
+	}
+
+	// Close ends the connection on purpose, that is not a loss
+	s2 := newTestConn(t, newTestServer(t))
+	s2.OnConnectionLost = func(err error) { lost <- err }
+	if err := s2.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	s2.Close()
+	select {
+	case err := <-lost:
+		t.Fatalf("OnConnectionLost called after Close: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPing(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	if _, err := s.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v before Connect, want ErrNotConnected", err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.Ping(context.Background()); err != nil || d < 0 {
+		t.Fatalf("Ping = %v, %v", d, err)
+	}
+
+	// a ping the server does not answer ends with ctx
+	srv.HoldKeepalives()
+	defer srv.ReleaseKeepalives()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	srv.ReleaseKeepalives()
+
+	srv.Close()
+	eventually(t, "the connection to be lost", func() bool { return s.GetStatus() == StatusDisconnected })
+	if _, err := s.Ping(context.Background()); err == nil {
+		t.Fatal("Ping succeeded after the server closed")
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	srv := newTestServer(t)
+	s := newTestConn(t, srv)
+	s.ClientVersion = "SSH-2.0-OpenSSH_9.0"
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.ClientVersions(); len(got) != 1 || got[0] != "SSH-2.0-OpenSSH_9.0" {
+		t.Fatalf("server saw %q, want SSH-2.0-OpenSSH_9.0", got)
+	}
+}
+
+func TestNewOverConn(t *testing.T) {
+	srv := newTestServer(t)
+	clientConn, serverConn := net.Pipe()
+	srv.ServeConn(serverConn)
+
+	s, err := NewOverConn(clientConn, "pipe", "test",
+		[]ssh.AuthMethod{ssh.PublicKeys(srv.ClientSigner)}, ssh.FixedHostKey(srv.HostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Logger = log.New(io.Discard, "", 0)
+	defer s.Close()
+	if s.GetStatus() != StatusConnected {
+		t.Fatalf("status %v, want connected", s.GetStatus())
+	}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "over a pipe")
+
+	if err := s.Connect(); err == nil {
+		t.Fatal("Connect succeeded on a connection made over a conn")
+	}
+	if err := s.Reconnect(); err == nil {
+		t.Fatal("Reconnect succeeded on a connection made over a conn")
+	}
+
+	// Close closes the pipe
+	s.Close()
+	if _, err := clientConn.Write([]byte("x")); err == nil {
+		t.Fatal("pipe still open after Close")
+	}
+}
+
+func TestNewOverConnHandshakeFails(t *testing.T) {
+	srv := newTestServer(t)
+	clientConn, serverConn := net.Pipe()
+	srv.ServeConn(serverConn)
+
+	other := newTestServer(t)
+	_, err := NewOverConn(clientConn, "pipe", "test",
+		[]ssh.AuthMethod{ssh.PublicKeys(srv.ClientSigner)}, ssh.FixedHostKey(other.HostKey))
+	if err == nil {
+		t.Fatal("handshake with the wrong host key succeeded")
+	}
+	if _, err := clientConn.Write([]byte("x")); err == nil {
+		t.Fatal("pipe left open after the failed handshake")
+	}
+}
+
+func TestLostConnectionGrace(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	s.LostConnectionGrace = time.Minute
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	conn := dial(t, addr)
+	echo(t, conn, "before the loss")
+
+	srv.Close()
+	clk.waitTimers(t, 1)
+	// the forward is kept during the grace period
+	time.Sleep(50 * time.Millisecond)
+	if n := len(s.Connections()); n != 1 {
+		t.Fatalf("%d connections listed during the grace period, want 1", n)
+	}
+	select {
+	case <-s.Done():
+		t.Fatal("Done closed during the grace period")
+	default:
+	}
+
+	clk.Advance(time.Minute)
+	eventually(t, "the forward to be closed", func() bool { return len(s.Connections()) == 0 })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("forwarded connection not closed: %v", err)
+	}
+	waitDone(t, s)
+}
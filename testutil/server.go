@@ -0,0 +1,657 @@
+// Package testutil provides an in-process ssh server to test code built on
+// sshts without a real ssh host.
+//
+//	srv, err := testutil.NewServer()
+//	...
+//	defer srv.Close()
+//	sshC := sshts.NewFromSigner("test", srv.ClientSigner, srv.Addr, ssh.FixedHostKey(srv.HostKey))
+//	sshC.Connect()
+//	go sshC.StartTunnel("localhost:15432", srv.EchoAddr)
+package testutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an ssh server listening on a loopback port. It accepts only
+// ClientSigner's key, answers keepalives, forwards direct-tcpip channels,
+// as used by tunnels and the socks5 proxy, to the requested address and
+// listens for tcpip-forward requests, as used by reverse tunnels and socks
+// BIND, and streamlocal-forward requests, as used by reverse unix tunnels.
+// EchoAddr is a tcp echo backend to use as a forward target.
+//
+// Session channels run exec requests with these built-in commands:
+//
+//	echo ARGS...     writes ARGS to stdout
+//	echoerr ARGS...  writes ARGS to stderr
+//	exit N           exits with status N
+//	printenv NAMES   writes the values of env variables set by the client
+//	sleep            runs until signalled or the session is closed
+//	follow ARGS...   writes ARGS to stdout, then runs like sleep
+//	agent            lists the fingerprints of the forwarded agent's keys
+//
+// Anything else exits 127. Env requests are accepted except for variables
+// starting with LD_. The sftp subsystem serves the local filesystem.
+type Server struct {
+	Addr         string
+	HostKey      ssh.PublicKey
+	ClientSigner ssh.Signer
+	// ClientKeyPEM is ClientSigner's private key as PKCS#8 PEM, for
+	// constructors taking key bytes or files.
+	ClientKeyPEM []byte
+	EchoAddr     string
+	// ServerVersion is the version string the server identifies with.
+	ServerVersion string
+
+	config   *ssh.ServerConfig
+	listener net.Listener
+	echo     net.Listener
+	wg       sync.WaitGroup
+	closed   chan struct{}
+
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{}
+	channelDelay time.Duration
+	hold         chan struct{}
+	holdPings    chan struct{}
+	opening      int
+	maxOpening   int
+	accepted     int
+	open         int
+	targets      []string
+	clients      []string
+	banner       string
+}
+
+// NewServer starts a Server with freshly generated host and client keys.
+func NewServer() (*Server, error) {
+	hostSigner, _, err := newSigner()
+	if err != nil {
+		return nil, err
+	}
+	clientSigner, clientPEM, err := newSigner()
+	if err != nil {
+		return nil, err
+	}
+	clientKey := clientSigner.PublicKey().Marshal()
+
+	config := &ssh.ServerConfig{
+		ServerVersion: "SSH-2.0-sshts-testutil",
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+	var s *Server
+	config.BannerCallback = func(ssh.ConnMetadata) string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.banner
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s = &Server{
+		Addr:          listener.Addr().String(),
+		HostKey:       hostSigner.PublicKey(),
+		ClientSigner:  clientSigner,
+		ClientKeyPEM:  clientPEM,
+		ServerVersion: config.ServerVersion,
+		EchoAddr:      echo.Addr().String(),
+		config:        config,
+		listener:      listener,
+		echo:          echo,
+		closed:        make(chan struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(2)
+	go s.serve()
+	go s.serveEcho()
+	return s, nil
+}
+
+// Close stops the server and the echo backend and closes all connections.
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+	s.listener.Close()
+	s.echo.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// SetChannelDelay makes the server wait d before answering each
+// direct-tcpip channel open, to test slow dials.
+func (s *Server) SetChannelDelay(d time.Duration) {
+	s.mu.Lock()
+	s.channelDelay = d
+	s.mu.Unlock()
+}
+
+// SetBanner makes the server send msg as the banner before
+// authentication, RFC 4252 5.4. An empty msg sends none.
+func (s *Server) SetBanner(msg string) {
+	s.mu.Lock()
+	s.banner = msg
+	s.mu.Unlock()
+}
+
+// HoldChannels makes direct-tcpip channel opens wait until
+// ReleaseChannels, to test dials given up while the server is answering.
+func (s *Server) HoldChannels() {
+	s.mu.Lock()
+	if s.hold == nil {
+		s.hold = make(chan struct{})
+	}
+	s.mu.Unlock()
+}
+
+// ReleaseChannels lets the channel opens held by HoldChannels proceed.
+func (s *Server) ReleaseChannels() {
+	s.mu.Lock()
+	if s.hold != nil {
+		close(s.hold)
+		s.hold = nil
+	}
+	s.mu.Unlock()
+}
+
+// HoldKeepalives makes the server wait with its answers to keepalive
+// requests until ReleaseKeepalives, to test pings given up.
+func (s *Server) HoldKeepalives() {
+	s.mu.Lock()
+	if s.holdPings == nil {
+		s.holdPings = make(chan struct{})
+	}
+	s.mu.Unlock()
+}
+
+// ReleaseKeepalives lets the answers held by HoldKeepalives be sent.
+func (s *Server) ReleaseKeepalives() {
+	s.mu.Lock()
+	if s.holdPings != nil {
+		close(s.holdPings)
+		s.holdPings = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) waitPings() {
+	s.mu.Lock()
+	hold := s.holdPings
+	s.mu.Unlock()
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-s.closed:
+		}
+	}
+}
+
+// MaxConcurrentOpens is the largest number of direct-tcpip channel opens
+// the server was answering at the same time.
+func (s *Server) MaxConcurrentOpens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxOpening
+}
+
+// ChannelCounts reports how many direct-tcpip channels the server
+// accepted and how many of them are still open.
+func (s *Server) ChannelCounts() (accepted, open int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted, s.open
+}
+
+// ClientVersions returns the identification string of every client that
+// authenticated, in order.
+func (s *Server) ClientVersions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.clients...)
+}
+
+// Targets returns the host:port of every direct-tcpip channel requested,
+// as the client sent it, so tests can see where names were resolved.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func newSigner() (ssh.Signer, []byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (s *Server) track(c net.Conn) {
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+func (s *Server) serveEcho() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.echo.Accept()
+		if err != nil {
+			return
+		}
+		s.track(conn)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.serveConn(conn)
+	}
+}
+
+// ServeConn serves an ssh client over conn in the background, e.g. one
+// end of a net.Pipe, as if it had connected to Addr.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveConn(newQueuedConn(conn))
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	select {
+	case <-s.closed:
+		conn.Close()
+		return
+	default:
+	}
+	s.track(conn)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.untrack(conn)
+		defer conn.Close()
+		s.handle(conn)
+	}()
+}
+
+// queuedConn sends its writes from a goroutine, in order. Both ssh sides
+// send their version and key exchange init before reading the other's,
+// which deadlocks on a conn without a buffer like net.Pipe.
+type queuedConn struct {
+	net.Conn
+	mu     sync.Mutex
+	queue  [][]byte
+	err    error
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newQueuedConn(conn net.Conn) *queuedConn {
+	c := &queuedConn{Conn: conn, wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	go c.send()
+	return c
+}
+
+func (c *queuedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, c.err
+	}
+	c.queue = append(c.queue, append([]byte(nil), p...))
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (c *queuedConn) send() {
+	for {
+		select {
+		case <-c.wake:
+		case <-c.closed:
+			return
+		}
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.mu.Unlock()
+		for _, p := range queue {
+			if _, err := c.Conn.Write(p); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (c *queuedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.clients = append(s.clients, string(sshConn.ClientVersion()))
+	s.mu.Unlock()
+	defer sshConn.Close()
+
+	go func() {
+		forwards := make(map[string]net.Listener)
+		defer func() {
+			for _, l := range forwards {
+				l.Close()
+			}
+		}()
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				s.tcpipForward(sshConn, req, forwards)
+			case "cancel-tcpip-forward":
+				var payload forwardPayload
+				ssh.Unmarshal(req.Payload, &payload)
+				key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+				l, ok := forwards[key]
+				if ok {
+					l.Close()
+					delete(forwards, key)
+				}
+				req.Reply(ok, nil)
+			case "streamlocal-forward@openssh.com":
+				s.streamLocalForward(sshConn, req, forwards)
+			case "cancel-streamlocal-forward@openssh.com":
+				var payload struct{ SocketPath string }
+				ssh.Unmarshal(req.Payload, &payload)
+				l, ok := forwards[payload.SocketPath]
+				if ok {
+					l.Close()
+					delete(forwards, payload.SocketPath)
+				}
+				req.Reply(ok, nil)
+			default:
+				// keepalive@openssh.com and other global requests
+				if req.Type == "keepalive@openssh.com" {
+					s.waitPings()
+				}
+				if req.WantReply {
+					req.Reply(req.Type == "keepalive@openssh.com", nil)
+				}
+			}
+		}
+	}()
+
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "direct-tcpip":
+			s.wg.Add(1)
+			go func(newChan ssh.NewChannel) {
+				defer s.wg.Done()
+				s.directTCPIP(newChan)
+			}(newChan)
+		case "session":
+			s.wg.Add(1)
+			go func(newChan ssh.NewChannel) {
+				defer s.wg.Done()
+				s.session(sshConn, newChan)
+			}(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "only direct-tcpip and session are supported")
+		}
+	}
+}
+
+type forwardPayload struct {
+	Addr string
+	Port uint32
+}
+
+// tcpipForward listens for a tcpip-forward request, RFC 4254 7.1, and
+// opens a forwarded-tcpip channel for each connection accepted.
+func (s *Server) tcpipForward(sshConn *ssh.ServerConn, req *ssh.Request, forwards map[string]net.Listener) {
+	var payload forwardPayload
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	forwards[net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))] = l
+	var reply []byte
+	if payload.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	req.Reply(true, reply)
+
+	s.forwardAccepted(sshConn, l, "forwarded-tcpip", func(conn net.Conn) []byte {
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		return ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)})
+	})
+}
+
+// streamLocalForward listens on the unix socket of a
+// streamlocal-forward@openssh.com request, as OpenSSH's PROTOCOL describes,
+// and opens a forwarded-streamlocal@openssh.com channel for each connection
+// accepted.
+func (s *Server) streamLocalForward(sshConn *ssh.ServerConn, req *ssh.Request, forwards map[string]net.Listener) {
+	var payload struct{ SocketPath string }
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	l, err := net.Listen("unix", payload.SocketPath)
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	forwards[payload.SocketPath] = l
+	req.Reply(true, nil)
+
+	s.forwardAccepted(sshConn, l, "forwarded-streamlocal@openssh.com", func(net.Conn) []byte {
+		return ssh.Marshal(struct {
+			SocketPath string
+			Reserved   string
+		}{SocketPath: payload.SocketPath})
+	})
+}
+
+// forwardAccepted opens a channel of chanType, with the extra data payload
+// returns, for every connection l accepts and relays between them.
+func (s *Server) forwardAccepted(sshConn *ssh.ServerConn, l net.Listener, chanType string, payload func(conn net.Conn) []byte) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ch, reqs, err := sshConn.OpenChannel(chanType, payload(conn))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			s.track(conn)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer s.untrack(conn)
+				relay(ch, conn)
+			}()
+		}
+	}()
+}
+
+// directTCPIP dials the target of a direct-tcpip channel, RFC 4254 7.2.
+func (s *Server) directTCPIP(newChan ssh.NewChannel) {
+	ch, target, ok := s.openDirectTCPIP(newChan)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	s.accepted++
+	s.open++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}()
+	relay(ch, target)
+}
+
+// relay copies between ch and conn until both directions are done and
+// closes them.
+func relay(ch ssh.Channel, target net.Conn) {
+	defer target.Close()
+	defer ch.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ch, target)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(target, ch)
+		if tc, ok := target.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// openDirectTCPIP answers a direct-tcpip channel open, once released if
+// held and after the channel delay, dialing the requested target.
+func (s *Server) openDirectTCPIP(newChan ssh.NewChannel) (ssh.Channel, net.Conn, bool) {
+	s.mu.Lock()
+	s.opening++
+	if s.opening > s.maxOpening {
+		s.maxOpening = s.opening
+	}
+	delay, hold := s.channelDelay, s.hold
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.opening--
+		s.mu.Unlock()
+	}()
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-s.closed:
+			newChan.Reject(ssh.ConnectionFailed, "server closed")
+			return nil, nil, false
+		}
+	}
+	select {
+	case <-time.After(delay):
+	case <-s.closed:
+		newChan.Reject(ssh.ConnectionFailed, "server closed")
+		return nil, nil, false
+	}
+
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return nil, nil, false
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	s.mu.Lock()
+	s.targets = append(s.targets, addr)
+	s.mu.Unlock()
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return nil, nil, false
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		target.Close()
+		return nil, nil, false
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, target, true
+}
@@ -0,0 +1,160 @@
+package testutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// session answers a session channel, RFC 4254 6, running the built-in
+// command of its exec request or the sftp subsystem.
+func (s *Server) session(sshConn *ssh.ServerConn, newChan ssh.NewChannel) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	signals := make(chan string, 1)
+	started := false
+	forwardAgent := false
+	env := make(map[string]string)
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.exec(sshConn, ch, payload.Command, env, forwardAgent, signals, stop)
+			}()
+		case "subsystem":
+			var payload struct{ Name string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" || !sftpSupported {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer ch.Close()
+				serveSFTP(ch)
+			}()
+		case "env":
+			// like an AcceptEnv allowing all but the loader's variables
+			var payload struct{ Name, Value string }
+			ok := !started && ssh.Unmarshal(req.Payload, &payload) == nil && !strings.HasPrefix(payload.Name, "LD_")
+			if ok {
+				env[payload.Name] = payload.Value
+			}
+			req.Reply(ok, nil)
+		case "auth-agent-req@openssh.com":
+			forwardAgent = !started
+			req.Reply(forwardAgent, nil)
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			select {
+			case signals <- payload.Signal:
+			default:
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// exec runs cmd on ch and reports how it ended with an exit-status or
+// exit-signal request before closing ch.
+func (s *Server) exec(sshConn *ssh.ServerConn, ch ssh.Channel, cmd string, env map[string]string, forwardAgent bool, signals <-chan string, stop <-chan struct{}) {
+	defer ch.Close()
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		args = []string{""}
+	}
+
+	status := 0
+	switch args[0] {
+	case "echo":
+		fmt.Fprintln(ch, strings.Join(args[1:], " "))
+	case "echoerr":
+		fmt.Fprintln(ch.Stderr(), strings.Join(args[1:], " "))
+	case "printenv":
+		for _, name := range args[1:] {
+			value, ok := env[name]
+			if !ok {
+				status = 1
+				continue
+			}
+			fmt.Fprintln(ch, value)
+		}
+	case "exit":
+		if len(args) > 1 {
+			status, _ = strconv.Atoi(args[1])
+		}
+	case "agent":
+		status = listAgentKeys(sshConn, ch, forwardAgent)
+	case "follow", "sleep":
+		if args[0] == "follow" {
+			fmt.Fprintln(ch, strings.Join(args[1:], " "))
+		}
+		select {
+		case sig := <-signals:
+			ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{Signal: sig}))
+			return
+		case <-stop:
+			return
+		case <-s.closed:
+			return
+		}
+	default:
+		fmt.Fprintf(ch.Stderr(), "%s: command not found\n", args[0])
+		status = 127
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+// listAgentKeys writes the fingerprints of the keys in the client's
+// forwarded agent to ch.
+func listAgentKeys(sshConn *ssh.ServerConn, ch ssh.Channel, forwardAgent bool) int {
+	if !forwardAgent {
+		fmt.Fprintln(ch.Stderr(), "agent: forwarding not requested")
+		return 1
+	}
+	agentCh, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "agent: %v\n", err)
+		return 1
+	}
+	defer agentCh.Close()
+	go ssh.DiscardRequests(reqs)
+	keys, err := agent.NewClient(agentCh).List()
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "agent: %v\n", err)
+		return 1
+	}
+	for _, key := range keys {
+		fmt.Fprintln(ch, ssh.FingerprintSHA256(key))
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+//go:build !js && !wasip1
+
+package testutil
+
+import (
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const sftpSupported = true
+
+// serveSFTP runs an sftp server on the local filesystem over ch until the
+// client ends the session.
+func serveSFTP(ch ssh.Channel) {
+	srv, err := sftp.NewServer(ch)
+	if err != nil {
+		return
+	}
+	srv.Serve()
+	srv.Close()
+}
@@ -0,0 +1,10 @@
+//go:build js || wasip1
+
+package testutil
+
+import "golang.org/x/crypto/ssh"
+
+// pkg/sftp does not build here, sftp subsystem requests are refused.
+const sftpSupported = false
+
+func serveSFTP(ch ssh.Channel) {}
@@ -0,0 +1,20 @@
+package sshts
+
+import "net"
+
+// Tracer is a hook for distributed tracing of forwarded connections. It
+// keeps this package free of a tracing dependency; an adapter can start an
+// OpenTelemetry span in StartSpan and set the attributes in End.
+type Tracer interface {
+	// StartSpan is called when a local tunnel accepts a connection from
+	// client, before the remote side is dialed.
+	StartSpan(client net.Addr) Span
+}
+
+// Span covers one forwarded connection, dial and transfer.
+type Span interface {
+	// End is called once the connection is finished with the target that
+	// was dialed, the bytes received through and sent into ssh, and the
+	// error that ended the connection, if any.
+	End(remote string, bytesIn, bytesOut int64, err error)
+}
@@ -0,0 +1,89 @@
+package sshts
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	client            net.Addr
+	remote            string
+	bytesIn, bytesOut int64
+	err               error
+	ended             chan struct{}
+}
+
+func (s *recordedSpan) End(remote string, bytesIn, bytesOut int64, err error) {
+	s.remote, s.bytesIn, s.bytesOut, s.err = remote, bytesIn, bytesOut, err
+	close(s.ended)
+}
+
+func (r *recordingTracer) StartSpan(client net.Addr) Span {
+	span := &recordedSpan{client: client, ended: make(chan struct{})}
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return span
+}
+
+// span waits for the first span to end and returns it.
+func (r *recordingTracer) span(t *testing.T) *recordedSpan {
+	t.Helper()
+	var span *recordedSpan
+	eventually(t, "a span to start", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.spans) > 0 {
+			span = r.spans[0]
+		}
+		return span != nil
+	})
+	select {
+	case <-span.ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("span not ended")
+	}
+	return span
+}
+
+func TestTracer(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	tracer := &recordingTracer{}
+	s.Tracer = tracer
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "traced")
+	conn.Close()
+
+	span := tracer.span(t)
+	if span.client.String() != conn.LocalAddr().String() {
+		t.Errorf("span client %s, want %s", span.client, conn.LocalAddr())
+	}
+	if span.remote != srv.EchoAddr || span.bytesIn != 6 || span.bytesOut != 6 || span.err != nil {
+		t.Errorf("span ended with %s, %d in, %d out, %v", span.remote, span.bytesIn, span.bytesOut, span.err)
+	}
+}
+
+func TestTracerDialError(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	tracer := &recordingTracer{}
+	s.Tracer = tracer
+	remote := closedAddr(t)
+	addr := startTestTunnel(t, s, remote)
+
+	dial(t, addr)
+	span := tracer.span(t)
+	if span.remote != remote || span.err == nil {
+		t.Errorf("span ended with %s, %v, want %s and the dial error", span.remote, span.err, remote)
+	}
+}
@@ -1,43 +1,385 @@
 package sshts
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 //StartTunnel listne a local port and map to remote
+//it blocks until the listener fails or the SSHConn is closed
+//remote may be just a port, "5432" or ":5432", for 127.0.0.1 on the server
+//before Connect it returns ErrNotConnected
 
 func (s *SSHConn) StartTunnel(local, remote string) error {
-	listener, err := net.Listen("tcp", local)
+	listener, err := s.listenTunnel(local)
+	if err == errClosing {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	return s.serveTunnel(listener, remote)
+}
+
+// Quick connects to sshServer with the key in keyFile, like New, and maps
+// localAddr to remoteAddr in the background. Closing the returned Closer
+// stops the tunnel and closes the connection.
+func Quick(user, keyFile, sshServer, localAddr, remoteAddr string) (io.Closer, error) {
+	s, err := New(user, keyFile, sshServer)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Connect(); err != nil {
+		return nil, err
+	}
+	listener, err := s.listenTunnel(localAddr)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.serveInBackground(func() error {
+		return s.serveTunnel(listener, remoteAddr)
+	})
+	return s, nil
+}
+
+// StartMultiTunnel listens on every address in locals, e.g. both
+// "127.0.0.1:5432" and "[::1]:5432", and maps them all to remote, sharing
+// MaxConnections and the other limits. It blocks until all listeners
+// stopped and returns the first error.
+func (s *SSHConn) StartMultiTunnel(locals []string, remote string) error {
+	var listeners []net.Listener
+	for _, local := range locals {
+		listener, err := s.listenTunnel(local)
+		if err != nil {
+			for _, l := range listeners {
+				s.untrackListener(l)
+				l.Close()
+			}
+			if err == errClosing {
+				return nil
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- s.serveTunnel(listener, remote)
+		}(listener)
+	}
+	var first error
+	for range listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *SSHConn) listenTunnel(local string) (net.Listener, error) {
+	if _, err := s.client(); err != nil {
+		return nil, err
+	}
+	listener, err := s.listen(local)
+	if err != nil {
+		return nil, err
+	}
+	if !s.trackListener(listener) {
+		return nil, errClosing
+	}
+	return listener, nil
+}
+
+func (s *SSHConn) serveTunnel(listener net.Listener, remote string) error {
+	remote = normalizeRemoteAddr(remote)
+	return s.acceptLoop(listener, func(network string, local net.Addr) (net.Conn, string, error) {
+		target := remote
+		if s.RemoteAddrFunc != nil {
+			var err error
+			if target, err = s.RemoteAddrFunc(local); err != nil {
+				return nil, "", fmt.Errorf("no remote address for %s: %v", local, err)
+			}
+			target = normalizeRemoteAddr(target)
+		}
+		conn, err := s.dialRemote(network, target)
+		return conn, target, err
+	})
+}
+
+// dialFunc opens the remote side of a connection accepted on the local
+// address local and reports the target address it dialed.
+type dialFunc func(network string, local net.Addr) (conn net.Conn, addr string, err error)
+
+// acceptLoop forwards every connection accepted on listener to a conn
+// opened by dial, using AcceptConcurrency goroutines to accept.
+func (s *SSHConn) acceptLoop(listener net.Listener, dial dialFunc) error {
+	defer s.untrackListener(listener)
 	defer listener.Close()
 
+	allowed, err := parseCIDRs(s.AllowedClientCIDRs)
+	if err != nil {
+		return err
+	}
+
+	n := s.AcceptConcurrency
+	if n < 1 {
+		n = 1
+	}
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		started := s.spawn(func() {
+			errs <- s.accept(listener, allowed, dial)
+			// stop the other acceptors, their errors are not reported
+			listener.Close()
+		})
+		if !started {
+			errs <- nil
+		}
+	}
+	err = <-errs
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+	return err
+}
+
+// accept runs one accept loop on listener until it fails or the SSHConn is
+// closed.
+func (s *SSHConn) accept(listener net.Listener, allowed []*net.IPNet, dial dialFunc) error {
+	var tempDelay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.acceptStopped() {
+				return nil
+			}
+			// back off on errors like running out of file descriptors
+			// instead of spinning, as net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				s.logf("accept error: %s; retrying in %v", err, tempDelay)
+				<-s.clk().After(tempDelay)
+				continue
+			}
 			return err
 		}
+		tempDelay = 0
 
-		go s.forward(conn, remote)
+		if !clientAllowed(allowed, conn.RemoteAddr()) {
+			s.reject(fmt.Errorf("connection from %s rejected, not in allowed client cidrs", conn.RemoteAddr()))
+			conn.Close()
+			continue
+		}
+
+		if !s.spawn(func() { s.forward(conn, dial) }) {
+			conn.Close()
+			return nil
+		}
 	}
 }
-func (s *SSHConn) forward(localConn net.Conn, remote string) {
 
-	remoteConn, err := s.sshClient.Dial("tcp", remote)
-	if err != nil {
-		fmt.Printf("remote dial error: %s", err)
+func (s *SSHConn) forward(localConn net.Conn, dial dialFunc) {
+	accepted := s.clk().Now()
+	if !s.trackConn(localConn) {
+		return
+	}
+	defer s.untrackConn(localConn)
+	defer localConn.Close()
+
+	if s.quotaExceeded() {
+		s.reject(fmt.Errorf("connection from %s rejected, quota of %d bytes reached", localConn.RemoteAddr(), s.MaxTotalBytes))
+		return
+	}
+	if !s.acquireSlot() {
+		s.limitExceeded(localConn)
 		return
 	}
+	defer s.releaseSlot()
 
-	copyConn := func(writer, reader net.Conn) {
-		_, err := io.Copy(writer, reader)
+	entry := s.addConnEntry(localConn)
+	defer s.removeConnEntry(entry)
+	entry.setDuration(&entry.wait, entry.started.Sub(accepted))
+
+	var span Span
+	if s.Tracer != nil {
+		span = s.Tracer.StartSpan(localConn.RemoteAddr())
+	}
+	if s.OnConnect != nil {
+		s.OnConnect(entry.info())
+	}
+	res := s.forwardConn(localConn, dial, entry)
+	if res.err != nil && !s.isClosing() {
+		s.setLastError(res.err)
+		s.logf("[%s] %s", entry.id, res.err)
+	}
+	if s.LogConnections && res.remote != "" {
+		s.logf("[%s] %s -> %s closed, %d bytes in, %d bytes out",
+			entry.id, localConn.RemoteAddr(), res.remote, res.bytesIn, res.bytesOut)
+	}
+	if s.AccessLog != nil {
+		s.writeAccessLog(entry, res)
+	}
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(entry.info(), res.err)
+	}
+	if span != nil {
+		span.End(res.remote, res.bytesIn, res.bytesOut, res.err)
+	}
+}
+
+type forwardResult struct {
+	remote            string
+	bytesIn, bytesOut int64
+	err               error
+}
+
+// forwardConn dials the remote side for localConn and copies data until
+// either side ends.
+func (s *SSHConn) forwardConn(localConn net.Conn, dial dialFunc, entry *connEntry) (res forwardResult) {
+	if s.LocalTLSConfig != nil {
+		tlsConn := tls.Server(localConn, s.LocalTLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			res.err = fmt.Errorf("tls handshake with %s failed: %v", localConn.RemoteAddr(), err)
+			return res
+		}
+		localConn = tlsConn
+	}
+
+	dialStart := s.clk().Now()
+	remoteConn, remote, err := dial("tcp", localConn.LocalAddr())
+	dialed := s.clk().Now()
+	res.remote = remote
+	entry.setRemote(remote)
+	entry.setDuration(&entry.dial, dialed.Sub(dialStart))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if s.LogConnections {
+		s.logf("[%s] %s -> %s", entry.id, localConn.RemoteAddr(), remote)
+	}
+	if !s.trackConn(remoteConn) {
+		res.err = errClosing
+		return res
+	}
+	defer s.untrackConn(remoteConn)
+	defer remoteConn.Close()
+
+	if s.SendProxyProtocol != 0 {
+		err := writeProxyHeader(remoteConn, s.SendProxyProtocol, localConn.RemoteAddr(), localConn.LocalAddr())
 		if err != nil {
-			fmt.Printf("io.Copy error: %s", err)
+			res.err = fmt.Errorf("failed to send proxy protocol header: %v", err)
+			return res
+		}
+	}
+
+	if s.RemoteTLSConfig != nil {
+		conf := s.RemoteTLSConfig.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName, _, _ = net.SplitHostPort(remote)
+		}
+		tlsConn := tls.Client(remoteConn, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			res.err = fmt.Errorf("tls handshake with %s failed: %v", remote, err)
+			return res
 		}
+		remoteConn = tlsConn
 	}
-	go copyConn(localConn, remoteConn)
-	go copyConn(remoteConn, localConn)
+
+	remoteConn = &firstByteConn{Conn: remoteConn, read: func() {
+		entry.setDuration(&entry.firstByte, s.clk().Now().Sub(dialed))
+	}}
+	res.bytesIn, res.bytesOut = s.pipe(localConn, remoteConn, &entry.counters)
+	return res
+}
+
+// pipe copies data both ways between the local side and the side reached
+// through ssh until both directions ended. When one direction reaches EOF
+// its destination is half-closed so the other can still flush, if the
+// conns cannot be half-closed or a copy fails both are closed at once.
+// counters, if not nil, are kept up to date while data flows.
+func (s *SSHConn) pipe(local, remote io.ReadWriteCloser, counters *byteCounters) (bytesIn, bytesOut int64) {
+	if counters == nil {
+		counters = &byteCounters{}
+	}
+	s.stats.total.Add(1)
+	s.stats.active.Add(1)
+	defer s.stats.active.Add(-1)
+
+	if s.MaxConnectionDuration > 0 {
+		timer := s.clk().AfterFunc(s.MaxConnectionDuration, func() {
+			local.Close()
+			remote.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// done receives whether the copy ended with a half-close
+	done := make(chan bool, 2)
+	copyConn := func(dst, src io.ReadWriteCloser, size int, total, conn *atomic.Int64) {
+		err := s.copyData(dst, src, size, total, conn)
+		if err != nil && !s.isClosing() {
+			s.logf("copy error: %s", err)
+		}
+		done <- err == nil && closeWrite(dst) == nil
+	}
+	go copyConn(local, remote, s.downloadBufferSize(), &s.stats.bytesIn, &counters.bytesIn)
+	go copyConn(remote, local, s.uploadBufferSize(), &s.stats.bytesOut, &counters.bytesOut)
+	if halfClosed := <-done; !halfClosed {
+		local.Close()
+		remote.Close()
+	}
+	<-done
+	local.Close()
+	remote.Close()
+	return counters.bytesIn.Load(), counters.bytesOut.Load()
+}
+
+// closeWrite shuts down the writing side of c, if it supports that.
+func closeWrite(c io.ReadWriteCloser) error {
+	if t, ok := c.(*trackedConn); ok {
+		c = t.Conn
+	}
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+// ForwardStream connects rwc, e.g. stdin and stdout, to remoteAddr through
+// ssh and copies data until either side ends. This lets a program act as
+// an ssh ProxyCommand or be piped into other tools.
+func (s *SSHConn) ForwardStream(rwc io.ReadWriteCloser, remoteAddr string) error {
+	if _, err := s.client(); err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	remoteConn, err := s.dialRemote("tcp", remoteAddr)
+	if err != nil {
+		return err
+	}
+	if !s.trackConn(remoteConn) {
+		return errClosing
+	}
+	defer s.untrackConn(remoteConn)
+	defer remoteConn.Close()
+
+	s.pipe(rwc, remoteConn, nil)
+	return nil
 }
@@ -0,0 +1,598 @@
+package sshts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kslamph/sshts/testutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestServer(t testing.TB) *testutil.Server {
+	t.Helper()
+	srv, err := testutil.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// newTestConn returns an SSHConn for srv that is not connected yet.
+func newTestConn(t testing.TB, srv *testutil.Server) *SSHConn {
+	t.Helper()
+	s := NewFromSigner("test", srv.ClientSigner, srv.Addr, ssh.FixedHostKey(srv.HostKey))
+	s.Logger = log.New(io.Discard, "", 0)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func connectTestConn(t testing.TB, srv *testutil.Server) *SSHConn {
+	t.Helper()
+	s := newTestConn(t, srv)
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// startTestTunnel starts a tunnel to remote on a free loopback port and
+// returns its address.
+func startTestTunnel(t testing.TB, s *SSHConn, remote string) string {
+	t.Helper()
+	listener, err := s.listenTunnel("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveTunnel(listener, remote)
+	return listener.Addr().String()
+}
+
+// echo writes msg to conn and fails unless it is read back.
+func echo(t testing.TB, conn net.Conn, msg string) {
+	t.Helper()
+	if err := echoErr(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoErr is echo for goroutines other than the test's.
+func echoErr(conn net.Conn, msg string) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("got %q, want %q", buf, msg)
+	}
+	return nil
+}
+
+// refused reports whether conn was closed without forwarding data.
+func refused(conn net.Conn) bool {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	conn.Write([]byte("x"))
+	_, err := conn.Read(make([]byte, 1))
+	return err != nil
+}
+
+// eventually fails unless cond becomes true within a few seconds.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelRoundTrip(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data changed in the tunnel")
+	}
+}
+
+func TestCloseDuringAcceptNoLeak(t *testing.T) {
+	srv := newTestServer(t)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		s := connectTestConn(t, srv)
+		s.AcceptConcurrency = 2
+		addr := startTestTunnel(t, s, srv.EchoAddr)
+
+		// keep connecting while Close runs
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						return
+					}
+					conn.Write([]byte("x"))
+					conn.Read(make([]byte, 1))
+					conn.Close()
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		close(stop)
+		wg.Wait()
+	}
+	eventually(t, "goroutines to exit", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 and localhost and a
+// pool trusting it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestLocalTLS(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	cert, pool := selfSignedCert(t)
+	s.LocalTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "over tls")
+}
+
+func TestRemoteTLS(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	cert, pool := selfSignedCert(t)
+
+	serverNames := make(chan string, 1)
+	remote, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNames <- hello.ServerName
+			return &cert, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go func() {
+		conn, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	s.RemoteTLSConfig = &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	addr := startTestTunnel(t, s, remote.Addr().String())
+	echo(t, dial(t, addr), "plain locally")
+	if name := <-serverNames; name != "localhost" {
+		t.Fatalf("remote got server name %q, want localhost", name)
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	// the backend only answers once the request ended with EOF
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(conn, "got %q", req)
+	}()
+	addr := startTestTunnel(t, s, backend.Addr().String())
+
+	conn := dial(t, addr)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("request"))
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != `got "request"` {
+		t.Fatalf("reply %q after half-close", reply)
+	}
+}
+
+func BenchmarkAcceptConcurrency(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("acceptors=%d", n), func(b *testing.B) {
+			srv := newTestServer(b)
+			s := connectTestConn(b, srv)
+			s.AcceptConcurrency = n
+			addr := startTestTunnel(b, s, srv.EchoAddr)
+
+			// bursts of short lived connections
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if err := echoErr(conn, "x"); err != nil {
+						b.Error(err)
+					}
+					conn.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestListenConfigControl(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	var mu sync.Mutex
+	var addrs []string
+	s.ListenConfig = &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		mu.Lock()
+		addrs = append(addrs, address)
+		mu.Unlock()
+		return nil
+	}}
+
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+	echo(t, dial(t, addr), "controlled")
+	startSocksTestServer(t, s.StartSocks5Server)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:0" {
+		t.Fatalf("Control called for %v, want the tunnel and the socks server", addrs)
+	}
+}
+
+func TestForwardStream(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	local, stream := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- s.ForwardStream(stream, srv.EchoAddr) }()
+
+	echo(t, local, "over a pipe")
+	local.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForwardStream did not return after the stream closed")
+	}
+}
+
+func TestForwardStreamNotConnected(t *testing.T) {
+	s := newTestConn(t, newTestServer(t))
+	_, stream := net.Pipe()
+	if err := s.ForwardStream(stream, "127.0.0.1:1"); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("got %v, want ErrNotConnected", err)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// temporaryListener fails the first fail accepts with a temporary error.
+type temporaryListener struct {
+	*fakeListener
+	fail    int32
+	accepts atomic.Int32
+}
+
+func (l *temporaryListener) Accept() (net.Conn, error) {
+	if l.accepts.Add(1) <= l.fail {
+		return nil, temporaryError{}
+	}
+	return l.fakeListener.Accept()
+}
+
+func TestAcceptBackoffFakeClock(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	clk := newFakeClock()
+	s.clock = clk
+	l := &temporaryListener{fakeListener: newFakeListener(), fail: 10}
+	defer l.Close()
+	go s.acceptLoop(l, func(network string, local net.Addr) (net.Conn, string, error) {
+		conn, err := s.dialRemote(network, srv.EchoAddr)
+		return conn, srv.EchoAddr, err
+	})
+
+	// doubling from 5ms, capped at a second
+	for i, want := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000} {
+		want *= time.Millisecond
+		clk.waitTimers(t, 1)
+		if n := l.accepts.Load(); n != int32(i+1) {
+			t.Fatalf("%d accepts before backoff %d, want %d", n, i, i+1)
+		}
+		clk.mu.Lock()
+		wait := clk.timers[0].at.Sub(clk.now)
+		clk.mu.Unlock()
+		if wait != want {
+			t.Fatalf("backoff %d is %v, want %v", i, wait, want)
+		}
+		clk.Advance(wait)
+	}
+
+	conn := l.connFrom("127.0.0.1:40000")
+	defer conn.Close()
+	echo(t, conn, "after backoff")
+}
+
+func TestStartMultiTunnel(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	s.MaxConnections = 1
+	locals := []string{closedAddr(t), closedAddr(t)}
+	done := make(chan error, 1)
+	go func() { done <- s.StartMultiTunnel(locals, srv.EchoAddr) }()
+
+	var conns []net.Conn
+	for _, local := range locals {
+		var conn net.Conn
+		eventually(t, local+" to listen", func() bool {
+			var err error
+			conn, err = net.Dial("tcp", local)
+			return err == nil
+		})
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// the listeners share MaxConnections
+	echo(t, conns[0], "first listener")
+	if !refused(conns[1]) {
+		t.Fatal("second listener forwarded over the shared limit")
+	}
+	conns[0].Close()
+	eventually(t, "the slot to be released", func() bool { return s.StatsSnapshot().Active == 0 })
+	conn := dial(t, locals[1])
+	echo(t, conn, "second listener")
+
+	s.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartMultiTunnel did not return after Close")
+	}
+}
+
+func TestStartMultiTunnelListenError(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	free := closedAddr(t)
+	if err := s.StartMultiTunnel([]string{free, "127.0.0.1:bad"}, srv.EchoAddr); err == nil {
+		t.Fatal("listening on an invalid address succeeded")
+	}
+	// the listener opened before the error is closed again
+	if conn, err := net.Dial("tcp", free); err == nil {
+		conn.Close()
+		t.Fatalf("%s still listening", free)
+	}
+}
+
+func TestLogConnections(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+	var logged syncBuffer
+	s.Logger = log.New(&logged, "", 0)
+	s.LogConnections = true
+	addr := startTestTunnel(t, s, srv.EchoAddr)
+
+	conn := dial(t, addr)
+	echo(t, conn, "hello")
+	client := conn.LocalAddr().String()
+	open := fmt.Sprintf("[1] %s -> %s\n", client, srv.EchoAddr)
+	eventually(t, "the open line", func() bool { return strings.Contains(logged.String(), open) })
+
+	conn.Close()
+	closed := fmt.Sprintf("[1] %s -> %s closed, 5 bytes in, 5 bytes out\n", client, srv.EchoAddr)
+	eventually(t, "the close line", func() bool { return strings.Contains(logged.String(), closed) })
+
+	socks := startSocksTestServer(t, func(addr string) error { return s.StartSocks5Server(addr) })
+	echo(t, dialSocks5(t, socks, srv.EchoAddr), "via socks")
+	if want := "socks5 -> " + srv.EchoAddr + "\n"; !strings.Contains(logged.String(), want) {
+		t.Fatalf("%q not logged in\n%s", want, logged.String())
+	}
+}
+
+func TestQuick(t *testing.T) {
+	srv := newTestServer(t)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, srv.ClientKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	local := closedAddr(t)
+	closer, err := Quick("test", keyFile, srv.Addr, local, srv.EchoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, dial(t, local), "quick")
+
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", local); err == nil {
+		conn.Close()
+		t.Fatal("tunnel still listening after Close")
+	}
+
+	if _, err := Quick("test", filepath.Join(t.TempDir(), "missing"), srv.Addr, closedAddr(t), srv.EchoAddr); err == nil {
+		t.Fatal("Quick succeeded with a missing key file")
+	}
+}
+
+func TestRemoteAddrFunc(t *testing.T) {
+	srv := newTestServer(t)
+	s := connectTestConn(t, srv)
+
+	// a second backend that greets, to tell the targets apart
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("greeter\n"))
+			conn.Close()
+		}
+	}()
+	_, greeterPort, _ := net.SplitHostPort(greeter.Addr().String())
+
+	var mu sync.Mutex
+	targets := make(map[string]string)
+	s.RemoteAddrFunc = func(local net.Addr) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		target, ok := targets[local.String()]
+		if !ok {
+			return "", errors.New("unknown listener")
+		}
+		return target, nil
+	}
+	echoLocal := startTestTunnel(t, s, "unused:1")
+	greeterLocal := startTestTunnel(t, s, "unused:1")
+	unknownLocal := startTestTunnel(t, s, "unused:1")
+	mu.Lock()
+	targets[echoLocal] = srv.EchoAddr
+	// a bare port is normalized like the remote passed to StartTunnel
+	targets[greeterLocal] = greeterPort
+	mu.Unlock()
+
+	echo(t, dial(t, echoLocal), "to the echo backend")
+	line, err := bufio.NewReader(dial(t, greeterLocal)).ReadString('\n')
+	if err != nil || line != "greeter\n" {
+		t.Fatalf("read %q, %v from the greeter", line, err)
+	}
+	if got := srv.Targets(); len(got) != 2 || got[0] != srv.EchoAddr || got[1] != "127.0.0.1:"+greeterPort {
+		t.Fatalf("server dialed %q", got)
+	}
+
+	// an error from RemoteAddrFunc closes the connection without a dial
+	if !refused(dial(t, unknownLocal)) {
+		t.Fatal("connection forwarded without a remote address")
+	}
+	eventually(t, "the error to be recorded", func() bool {
+		err := s.LastError()
+		return err != nil && strings.Contains(err.Error(), "unknown listener")
+	})
+	if got := srv.Targets(); len(got) != 2 {
+		t.Fatalf("server dialed %q after the error", got)
+	}
+}